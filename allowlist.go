@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ClientAllowlist is the set of client pubkeys a server accepts sessions from.
+// A nil allowlist accepts every client
+type ClientAllowlist struct {
+	pubkeys map[string]struct{}
+}
+
+// LoadClientAllowlist parses the -allowed-clients value: the path of a file with one
+// pubkey per line (blank lines and # comments are ignored), or a comma-separated list.
+// Pubkeys may be hex or npub. An empty value returns nil, allowing everyone
+func LoadClientAllowlist(value string) (*ClientAllowlist, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var entries []string
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		file, err := os.Open(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open allowed clients file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read allowed clients file: %v", err)
+		}
+	} else {
+		entries = strings.Split(value, ",")
+	}
+
+	allowlist := &ClientAllowlist{pubkeys: make(map[string]struct{})}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pubkey, err := ParsePublicKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed client %q: %v", entry, err)
+		}
+		// Event pubkeys are lowercase hex
+		allowlist.pubkeys[strings.ToLower(pubkey)] = struct{}{}
+	}
+	if len(allowlist.pubkeys) == 0 {
+		return nil, fmt.Errorf("allowed clients list %q contains no pubkeys", value)
+	}
+	return allowlist, nil
+}
+
+// Allows reports whether a client may open sessions
+func (al *ClientAllowlist) Allows(clientPubkey string) bool {
+	if al == nil {
+		return true
+	}
+	_, allowed := al.pubkeys[clientPubkey]
+	return allowed
+}
+
+// Len returns the number of allowed clients
+func (al *ClientAllowlist) Len() int {
+	if al == nil {
+		return 0
+	}
+	return len(al.pubkeys)
+}
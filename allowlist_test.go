@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func newTestPubkey(t *testing.T) string {
+	t.Helper()
+	pubkey, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubkey
+}
+
+func TestLoadClientAllowlist(t *testing.T) {
+	alice, bob, carol := newTestPubkey(t), newTestPubkey(t), newTestPubkey(t)
+	bobNpub, err := nip19.EncodePublicKey(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		allowed []string
+		denied  []string
+		wantErr bool
+	}{
+		{name: "hex", value: alice, allowed: []string{alice}, denied: []string{bob}},
+		{name: "npub", value: bobNpub, allowed: []string{bob}, denied: []string{alice}},
+		{name: "mixed case hex", value: strings.ToUpper(alice), allowed: []string{alice}},
+		{name: "comma-separated", value: alice + ", " + bobNpub + ",", allowed: []string{alice, bob}, denied: []string{carol}},
+		{
+			name:    "file with comments and blank lines",
+			value:   writeFile("clients", "# Allowed clients\n\n"+alice+"\n  "+bobNpub+"  # Bob\n\n"),
+			allowed: []string{alice, bob},
+			denied:  []string{carol},
+		},
+		{name: "invalid entry", value: alice + ",nothex", wantErr: true},
+		{name: "invalid entry in file", value: writeFile("invalid", alice+"\nnpub1nope\n"), wantErr: true},
+		{name: "empty value allows everyone", value: "", allowed: []string{alice, bob, carol}},
+		{name: "only separators", value: " , ,", wantErr: true},
+		{name: "file without pubkeys", value: writeFile("empty", "# Nobody yet\n\n"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		allowlist, err := LoadClientAllowlist(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		for _, pubkey := range tt.allowed {
+			if !allowlist.Allows(pubkey) {
+				t.Errorf("%s: %s is not allowed", tt.name, pubkey)
+			}
+		}
+		for _, pubkey := range tt.denied {
+			if allowlist.Allows(pubkey) {
+				t.Errorf("%s: %s is allowed", tt.name, pubkey)
+			}
+		}
+	}
+}
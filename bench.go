@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Defaults of the bench mode
+const (
+	defaultBenchSize  = 4 * 1024 * 1024 // Bytes sent in each direction
+	defaultBenchPings = 50              // Round trips timed for the latency report
+	benchPingSize     = 64              // Bytes per ping, small enough for one packet
+	benchTimeout      = 5 * time.Minute // Gives up on a phase that makes no progress, e.g. when relays are unreachable
+)
+
+// Commands understood by the bench target, sent as the first byte of a connection
+const (
+	benchCommandEcho     = 'e' // Echo everything back
+	benchCommandUpload   = 'u' // Read until EOF, then answer with the byte count
+	benchCommandDownload = 'd' // Read a byte count, then send that many bytes
+)
+
+// runBench runs a client and a server in this process, connected through the configured relays,
+// and reports latency and throughput of a real session along with event and packet counters
+func runBench(relayURLs []string, keyPoolSize, keyMaxUses int, replayWindow time.Duration, sessionConfig *SessionConfig, benchSize, benchPings int, verbose bool) {
+	// Show startup banner
+	fmt.Print(GetBanner())
+
+	// Stay within the message size every relay accepts
+	sessionConfig.MaxEventSize = discoverMaxEventSize(relayURLs, sessionConfig.MaxEventSize, verbose)
+
+	// Both sides count into the same stats
+	stats := &SessionStats{}
+	sessionConfig.Stats = stats
+
+	fmt.Printf("Starting benchmark (Nostr mode):\n")
+	fmt.Printf("  Relay URLs: %v\n", relayURLs)
+	fmt.Printf("  Transfer size: %d bytes each way\n", benchSize)
+	fmt.Printf("  Pings: %d\n", benchPings)
+	fmt.Printf("  Max event size: %d bytes\n", sessionConfig.MaxEventSize)
+	if sessionConfig.CoalesceDelay > 0 {
+		fmt.Printf("  Write coalescing: up to %v\n", sessionConfig.CoalesceDelay)
+	} else {
+		fmt.Printf("  Write coalescing: off (no-delay)\n")
+	}
+	fmt.Printf("  Compression: %s (benchmark data is random and does not compress)\n", sessionConfig.Compression)
+	if len(sessionConfig.PaddingBuckets) > 0 {
+		fmt.Printf("  Padding: to %s bytes\n", sessionConfig.PaddingBuckets)
+	} else {
+		fmt.Printf("  Padding: off\n")
+	}
+	if sessionConfig.CoverInterval > 0 {
+		fmt.Printf("  Cover traffic: every %v\n", sessionConfig.CoverInterval)
+	} else {
+		fmt.Printf("  Cover traffic: off\n")
+	}
+	fmt.Printf("  Verbose logging: %t\n\n", verbose)
+
+	// Local target the server connects to
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Failed to start benchmark target: %v", err)
+	}
+	defer target.Close()
+	go serveBenchTarget(target, verbose)
+
+	// Server side
+	serverKeyMgr := NewKeyManager("", keyPoolSize, keyMaxUses, replayWindow)
+	defer serverKeyMgr.Close()
+	if err := serverKeyMgr.GenerateKeys(); err != nil {
+		log.Fatalf("Failed to generate server keys: %v", err)
+	}
+	serverPubkey := serverKeyMgr.GetKeys().PublicKey
+
+	serverRelayHandler, err := NewNostrRelayHandler(relayURLs, serverKeyMgr, verbose)
+	if err != nil {
+		log.Fatalf("Failed to connect to relays: %v", err)
+	}
+	if err := serverRelayHandler.SubscribeToGiftWrapEvents(serverPubkey); err != nil {
+		log.Fatalf("Failed to subscribe to encrypted events: %v", err)
+	}
+	go monitorNostrSessionEvents(serverRelayHandler, serverKeyMgr, serverPubkey, target.Addr().String(), nil, sessionConfig, verbose)
+
+	// Client side
+	clientKeyMgr := NewKeyManager("", keyPoolSize, keyMaxUses, replayWindow)
+	defer clientKeyMgr.Close()
+	if err := clientKeyMgr.GenerateKeys(); err != nil {
+		log.Fatalf("Failed to generate client keys: %v", err)
+	}
+	clientPubkey := clientKeyMgr.GetKeys().PublicKey
+
+	clientRelayHandler, err := NewNostrRelayHandler(relayURLs, clientKeyMgr, verbose)
+	if err != nil {
+		log.Fatalf("Failed to connect to relays: %v", err)
+	}
+	if err := clientRelayHandler.SubscribeToGiftWrapEvents(clientPubkey); err != nil {
+		log.Fatalf("Failed to subscribe to encrypted events: %v", err)
+	}
+	router := NewSessionRouter(clientRelayHandler, clientKeyMgr, clientPubkey, "server_to_client", verbose)
+	go router.Run()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Failed to start benchmark client: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleClientConnectionNostr(conn, clientRelayHandler, router, clientKeyMgr, serverPubkey, sessionConfig, verbose)
+		}
+	}()
+	clientAddr := listener.Addr().String()
+
+	// Latency
+	fmt.Printf("Measuring round-trip time with %d pings of %d bytes...\n", benchPings, benchPingSize)
+	setupTime, rtts, err := benchPing(clientAddr, benchPings)
+	if err != nil {
+		log.Fatalf("Ping benchmark failed: %v", err)
+	}
+	fmt.Printf("  Session setup: %v\n", setupTime.Round(time.Millisecond))
+	fmt.Printf("  RTT min %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(rtts, 0).Round(time.Millisecond), percentile(rtts, 0.5).Round(time.Millisecond),
+		percentile(rtts, 0.9).Round(time.Millisecond), percentile(rtts, 0.99).Round(time.Millisecond),
+		percentile(rtts, 1).Round(time.Millisecond))
+
+	// Throughput
+	fmt.Printf("Measuring upload throughput with %d bytes...\n", benchSize)
+	elapsed, err := benchUpload(clientAddr, benchSize)
+	if err != nil {
+		log.Fatalf("Upload benchmark failed: %v", err)
+	}
+	fmt.Printf("  Upload: %s in %v\n", formatThroughput(benchSize, elapsed), elapsed.Round(time.Millisecond))
+
+	fmt.Printf("Measuring download throughput with %d bytes...\n", benchSize)
+	elapsed, err = benchDownload(clientAddr, benchSize)
+	if err != nil {
+		log.Fatalf("Download benchmark failed: %v", err)
+	}
+	fmt.Printf("  Download: %s in %v\n", formatThroughput(benchSize, elapsed), elapsed.Round(time.Millisecond))
+
+	// Let the last acks and closes go out before reading the counters
+	time.Sleep(time.Second)
+
+	fmt.Printf("\nEvents (publishes are counted once per relay):\n")
+	sides := []struct {
+		name         string
+		relayHandler *NostrRelayHandler
+	}{{"Client", clientRelayHandler}, {"Server", serverRelayHandler}}
+	var published, received [2]uint64
+	for i, side := range sides {
+		var failed, dropped uint64
+		published[i], failed, received[i], dropped = side.relayHandler.EventStats()
+		fmt.Printf("  %s: %d published, %d failed, %d received, %d dropped\n", side.name, published[i], failed, received[i], dropped)
+	}
+	// Events are received once however many relays carry them, so loss is only known for one relay
+	if len(relayURLs) == 1 {
+		for i, side := range sides {
+			peer := sides[1-i].name
+			fmt.Printf("  %s to %s: %.1f%% of published events lost\n", side.name, peer, lossPercent(published[i], received[1-i]))
+		}
+	}
+
+	sent := stats.PacketsSent.Load()
+	retransmitted := stats.Retransmissions.Load()
+	duplicates := stats.Duplicates.Load()
+	retransmitRate := 0.0
+	if sent > 0 {
+		retransmitRate = float64(retransmitted) / float64(sent) * 100
+	}
+	fmt.Printf("Packets:\n")
+	fmt.Printf("  %d sent, %d retransmitted (%.1f%% of sent), %d duplicates received\n", sent, retransmitted, retransmitRate, duplicates)
+}
+
+// lossPercent returns the share of published events that were never received
+func lossPercent(published, received uint64) float64 {
+	if published == 0 || received >= published {
+		return 0
+	}
+	return float64(published-received) / float64(published) * 100
+}
+
+// serveBenchTarget answers benchmark connections according to their first byte
+func serveBenchTarget(listener net.Listener, verbose bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			if err := handleBenchTarget(conn); err != nil && verbose {
+				log.Printf("Bench: Target connection failed: %v", err)
+			}
+		}(conn)
+	}
+}
+
+func handleBenchTarget(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(benchTimeout))
+	reader := bufio.NewReader(conn)
+
+	command, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case benchCommandEcho:
+		_, err = io.Copy(conn, reader)
+		return err
+
+	case benchCommandUpload:
+		received, err := io.Copy(io.Discard, reader)
+		if err != nil {
+			return err
+		}
+		return binary.Write(conn, binary.BigEndian, uint64(received))
+
+	case benchCommandDownload:
+		var size uint64
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return err
+		}
+		_, err = io.CopyN(conn, rand.New(rand.NewSource(time.Now().UnixNano())), int64(size))
+		return err
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// benchPing times the session setup and then pings small messages through an echo connection one at a time
+func benchPing(clientAddr string, pings int) (time.Duration, []time.Duration, error) {
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(benchTimeout))
+
+	// The first echo includes opening the session
+	start := time.Now()
+	if _, err := conn.Write([]byte{benchCommandEcho, 0}); err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return 0, nil, err
+	}
+	setupTime := time.Since(start)
+
+	ping := make([]byte, benchPingSize)
+	reply := make([]byte, benchPingSize)
+	rtts := make([]time.Duration, 0, pings)
+	for i := 0; i < pings; i++ {
+		rand.Read(ping)
+		start := time.Now()
+		if _, err := conn.Write(ping); err != nil {
+			return 0, nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return 0, nil, err
+		}
+		rtts = append(rtts, time.Since(start))
+		if string(reply) != string(ping) {
+			return 0, nil, fmt.Errorf("ping %d came back corrupted", i)
+		}
+	}
+	return setupTime, rtts, nil
+}
+
+// benchUpload sends size random bytes and returns the time until the target confirms them all
+func benchUpload(clientAddr string, size int) (time.Duration, error) {
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(benchTimeout))
+
+	start := time.Now()
+	if _, err := conn.Write([]byte{benchCommandUpload}); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(conn, rand.New(rand.NewSource(time.Now().UnixNano())), int64(size)); err != nil {
+		return 0, err
+	}
+	if err := closeWrite(conn); err != nil {
+		return 0, err
+	}
+
+	var received uint64
+	if err := binary.Read(conn, binary.BigEndian, &received); err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	if received != uint64(size) {
+		return 0, fmt.Errorf("target received %d of %d bytes", received, size)
+	}
+	return elapsed, nil
+}
+
+// benchDownload asks the target for size random bytes and returns the time until all arrived
+func benchDownload(clientAddr string, size int) (time.Duration, error) {
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(benchTimeout))
+
+	request := make([]byte, 9)
+	request[0] = benchCommandDownload
+	binary.BigEndian.PutUint64(request[1:], uint64(size))
+
+	start := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	received, err := io.Copy(io.Discard, conn)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	if received != int64(size) {
+		return 0, fmt.Errorf("received %d of %d bytes", received, size)
+	}
+	return elapsed, nil
+}
+
+// percentile returns the p-th percentile (0 to 1) of durations, sorting them in place
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[int(p*float64(len(durations)-1)+0.5)]
+}
+
+// formatThroughput renders bytes transferred in elapsed as KB/s or MB/s
+func formatThroughput(bytes int, elapsed time.Duration) string {
+	perSecond := float64(bytes) / elapsed.Seconds()
+	if perSecond >= 1024*1024 {
+		return fmt.Sprintf("%.2f MB/s", perSecond/(1024*1024))
+	}
+	return fmt.Sprintf("%.1f KB/s", perSecond/1024)
+}
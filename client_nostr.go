@@ -5,11 +5,10 @@ import (
 	"io"
 	"log"
 	"net"
-	"strings"
 	"time"
 )
 
-func runClientNostr(clientPort int, relayURLs []string, serverPubkey, privateKey string, verbose bool) {
+func runClientNostr(clientPort int, relayURLs []string, serverPubkey, privateKey string, keyPoolSize, keyMaxUses int, replayWindow time.Duration, sessionConfig *SessionConfig, verbose bool) {
 	// Show startup banner
 	fmt.Print(GetBanner())
 
@@ -28,14 +27,38 @@ func runClientNostr(clientPort int, relayURLs []string, serverPubkey, privateKey
 		log.Fatalf("Failed to parse server public key: %v", err)
 	}
 
+	// Stay within the message size every relay accepts
+	sessionConfig.MaxEventSize = discoverMaxEventSize(relayURLs, sessionConfig.MaxEventSize, verbose)
+
 	fmt.Printf("Starting TCP proxy client (Nostr mode):\n")
 	fmt.Printf("  Listen port: %d\n", clientPort)
 	fmt.Printf("  Server pubkey: %s\n", serverPubkeyHex)
 	fmt.Printf("  Relay URLs: %v\n", relayURLs)
+	fmt.Printf("  Gap timeout: %v\n", sessionConfig.GapTimeout)
+	fmt.Printf("  Heartbeat interval: %v (peer timeout %v)\n", sessionConfig.HeartbeatInterval, sessionConfig.PeerTimeout)
+	fmt.Printf("  Resume grace: %v\n", sessionConfig.ResumeGrace)
+	fmt.Printf("  Max event size: %d bytes\n", sessionConfig.MaxEventSize)
+	if sessionConfig.CoalesceDelay > 0 {
+		fmt.Printf("  Write coalescing: up to %v\n", sessionConfig.CoalesceDelay)
+	} else {
+		fmt.Printf("  Write coalescing: off (no-delay)\n")
+	}
+	fmt.Printf("  Compression: %s\n", sessionConfig.Compression)
+	if len(sessionConfig.PaddingBuckets) > 0 {
+		fmt.Printf("  Padding: to %s bytes\n", sessionConfig.PaddingBuckets)
+	} else {
+		fmt.Printf("  Padding: off\n")
+	}
+	if sessionConfig.CoverInterval > 0 {
+		fmt.Printf("  Cover traffic: every %v\n", sessionConfig.CoverInterval)
+	} else {
+		fmt.Printf("  Cover traffic: off\n")
+	}
 	fmt.Printf("  Verbose logging: %t\n\n", verbose)
 
 	// Initialize key manager
-	keyMgr := NewKeyManager("")
+	keyMgr := NewKeyManager("", keyPoolSize, keyMaxUses, replayWindow)
+	defer keyMgr.Close()
 	if privateKey != "" {
 		// Use provided private key
 		if err := keyMgr.LoadKeysFromPrivateKey(privateKey); err != nil {
@@ -71,6 +94,10 @@ func runClientNostr(clientPort int, relayURLs []string, serverPubkey, privateKey
 		log.Fatalf("Failed to subscribe to encrypted events: %v", err)
 	}
 
+	// Route server responses to their sessions from a single reader
+	router := NewSessionRouter(relayHandler, keyMgr, clientKeys.PublicKey, "server_to_client", verbose)
+	go router.Run()
+
 	// Start listening
 	listenAddr := fmt.Sprintf(":%d", clientPort)
 	listener, err := net.Listen("tcp", listenAddr)
@@ -93,191 +120,228 @@ func runClientNostr(clientPort int, relayURLs []string, serverPubkey, privateKey
 		}
 
 		// Handle each connection in a goroutine
-		go handleClientConnectionNostr(conn, relayHandler, keyMgr, serverPubkeyHex, clientKeys.PublicKey, verbose)
+		go handleClientConnectionNostr(conn, relayHandler, router, keyMgr, serverPubkeyHex, sessionConfig, verbose)
 	}
 }
 
-func sanitizeSessionID(sessionID string) string {
-	// Replace problematic characters that might cause issues in filenames
-	sessionID = strings.ReplaceAll(sessionID, ":", "_")
-	sessionID = strings.ReplaceAll(sessionID, ".", "_")
-	sessionID = strings.ReplaceAll(sessionID, "/", "_")
-	sessionID = strings.ReplaceAll(sessionID, "\\", "_")
-	return sessionID
-}
-
-func handleClientConnectionNostr(conn net.Conn, relayHandler *NostrRelayHandler, keyMgr *KeyManager, serverPubkeyHex, clientPubkey string, verbose bool) {
+func handleClientConnectionNostr(conn net.Conn, relayHandler *NostrRelayHandler, router *SessionRouter, keyMgr *KeyManager, serverPubkeyHex string, sessionConfig *SessionConfig, verbose bool) {
 	defer conn.Close()
 
+	// Random session IDs can't be guessed and say nothing about the local network
 	clientAddr := conn.RemoteAddr().String()
-	sessionID := fmt.Sprintf("session_%d_%s", time.Now().UnixNano(), clientAddr)
-	sessionID = sanitizeSessionID(sessionID)
+	sessionID := newRandomID()
 
 	if verbose {
 		log.Printf("Client: Starting Nostr session %s for %s", sessionID, clientAddr)
 	}
 
-	// Send open packet synchronously to ensure it arrives first
-	openPacket := CreateEmptyPacket()
-	if err := SendNostrPacketSync(relayHandler, keyMgr, openPacket, serverPubkeyHex, PacketTypeOpen, sessionID, 0, "client_to_server", "", 0, clientAddr, "", verbose); err != nil {
+	// Register with the router before sending open so no server response is missed
+	packetChan := router.Register(sessionID, serverPubkeyHex)
+	defer router.Unregister(sessionID)
+
+	// The server only learns the local client's address if asked to
+	forwardedAddr := ""
+	if sessionConfig.ForwardClientAddr {
+		forwardedAddr = clientAddr
+	}
+	session := NewTunnelSession(sessionID, "Client", relayHandler, keyMgr, serverPubkeyHex, "client_to_server", forwardedAddr, sessionConfig, verbose)
+	go session.Feed(packetChan)
+
+	// Send open packet (sequence 0); it is retransmitted with exponential backoff until the server acknowledges it
+	if err := session.Send(PacketTypeOpen, nil, session.HandshakeTags()...); err != nil {
 		log.Printf("Client: Failed to send open packet: %v", err)
 		return
 	}
 
+	// Hold the local client's data until the server has connected to the target
+	if err := awaitOpenAck(session, openAckTimeout); err != nil {
+		log.Printf("Client: Session %s - Server did not accept session: %v", sessionID, err)
+		resetConn(conn)
+		session.Close()
+		return
+	}
+
+	if verbose {
+		log.Printf("Client: Session %s - Server accepted session", sessionID)
+	}
+
 	// Start goroutine to read server responses
-	done := make(chan bool, 2)
-	go readServerNostrResponses(relayHandler, keyMgr, sessionID, clientPubkey, conn, done, verbose)
+	readerDone := make(chan struct{})
+	writeClosed := make(chan struct{})
+	go readServerNostrResponses(session, sessionID, conn, writeClosed, readerDone, verbose)
 
 	// Read data from client connection and send as packets
-	sequence := uint64(1)         // Start at 1 (open packet is 0)
 	buffer := make([]byte, 32768) // Increased from 4KB to 32KB for better throughput
 	// This reduces the number of Nostr events by 8x, significantly improving performance with remote relays
 
+	halfClosed := false
 	for {
 		n, err := conn.Read(buffer)
 		if err != nil {
-			if err != io.EOF {
-				if verbose {
-					log.Printf("Client: Session %s - Connection read error: %v", sessionID, err)
-				}
+			if err == io.EOF {
+				halfClosed = true
+			} else if verbose {
+				log.Printf("Client: Session %s - Connection read error: %v", sessionID, err)
 			}
 			break
 		}
 
 		if n > 0 {
-			// Create data packet
-			dataPacket := CreateDataPacket(buffer[:n])
-			if err := SendNostrPacket(relayHandler, keyMgr, dataPacket, serverPubkeyHex, PacketTypeData, sessionID, sequence, "client_to_server", "", 0, clientAddr, "", verbose); err != nil {
+			if err := session.Send(PacketTypeData, buffer[:n]); err != nil {
 				log.Printf("Client: Failed to send data packet: %v", err)
 				break
 			}
 
 			if verbose {
-				log.Printf("Client: Session %s - Sent %d bytes in packet (seq %d)", sessionID, n, sequence)
+				log.Printf("Client: Session %s - Sent %d bytes to server", sessionID, n)
 			}
-			sequence++
 		}
 	}
 
-	// Send close packet synchronously to ensure proper cleanup
-	closePacket := CreateEmptyPacket()
-	if err := SendNostrPacketSync(relayHandler, keyMgr, closePacket, serverPubkeyHex, PacketTypeClose, sessionID, sequence, "client_to_server", "", 0, clientAddr, "", verbose); err != nil {
-		log.Printf("Client: Failed to send close packet: %v", err)
+	select {
+	case <-readerDone:
+		// The server closed the session or it was aborted, so there is nobody left to tell
+	default:
+		if halfClosed {
+			// The local client shut down its sending side: forward the FIN and keep
+			// delivering the server's response until the server finishes too
+			if err := session.Send(PacketTypeFin, nil); err != nil && err != ErrSessionClosed {
+				log.Printf("Client: Failed to send fin packet: %v", err)
+			}
+			if verbose {
+				log.Printf("Client: Session %s - Local client finished sending, waiting for server", sessionID)
+			}
+			close(writeClosed)
+			<-readerDone
+		} else {
+			if err := session.Send(PacketTypeClose, nil); err != nil && err != ErrSessionClosed {
+				log.Printf("Client: Failed to send close packet: %v", err)
+			}
+		}
 	}
 
-	done <- true
+	// Wait for the server to acknowledge outstanding packets
+	session.Close()
+
 	if verbose {
 		log.Printf("Client: Session %s closed", sessionID)
+		hits, misses, size := keyMgr.ReceiveKeyCacheStats()
+		log.Printf("Client: Conversation key cache: %d hits, %d misses, %d keys", hits, misses, size)
+		ready, generatedInline := keyMgr.KeyPoolStats()
+		log.Printf("Client: One-time key pool: %d keys ready, %d generated inline", ready, generatedInline)
+		rejected, remembered := keyMgr.ReplayStats()
+		log.Printf("Client: Replay protection: %d rumors rejected, %d ids remembered", rejected, remembered)
 	}
 }
 
-func readServerNostrResponses(relayHandler *NostrRelayHandler, keyMgr *KeyManager, sessionID, clientPubkey string, conn net.Conn, done chan bool, verbose bool) {
-	defer func() { done <- true }()
+// openAckTimeout bounds how long a client waits for the server to accept a session; it
+// covers the server's dial of the target and some relay delay
+const openAckTimeout = 30 * time.Second
+
+// awaitOpenAck waits for the server's answer to our open packet, which is the first
+// packet of its direction, and returns an error unless the server accepted the session
+// within timeout
+func awaitOpenAck(session *TunnelSession, timeout time.Duration) error {
+	var pkt *ParsedPacket
+	ok := false
+	select {
+	case pkt, ok = <-session.Incoming():
+	case <-time.After(timeout):
+		err := fmt.Errorf("no open_ack from server within %v", timeout)
+		session.Abort(err)
+		return err
+	}
+	if !ok {
+		if err := session.Err(); err != nil {
+			return err
+		}
+		return ErrSessionClosed
+	}
+
+	switch {
+	case pkt.Type == PacketTypeOpenAck && pkt.Status == "accept":
+		return nil
+	case pkt.Type == PacketTypeOpenAck, pkt.Type == PacketTypeClose:
+		if pkt.ErrorCode != "" {
+			return &TunnelError{Code: pkt.ErrorCode, Detail: pkt.ErrorMsg}
+		}
+		return fmt.Errorf("server sent %s without accepting: %s", pkt.Type, pkt.ErrorMsg)
+	default:
+		err := fmt.Errorf("unexpected %s packet before open_ack", pkt.Type)
+		session.Abort(err)
+		return err
+	}
+}
 
-	processedSequences := make(map[uint64]bool)
-	nextExpectedSequence := uint64(0)
-	pendingPackets := make(map[uint64]*ParsedPacket) // Buffer for out-of-order packets
+// readServerNostrResponses writes the server's data to the local connection until both
+// directions are finished (writeClosed is closed and the server sent a fin), the server
+// closes the session, or the session is aborted
+func readServerNostrResponses(session *TunnelSession, sessionID string, conn net.Conn, writeClosed <-chan struct{}, done chan struct{}, verbose bool) {
+	defer close(done)
 
+	serverFinished := false
 	for {
 		select {
-		case <-done:
-			return
-		case event := <-relayHandler.GetEventChannel():
-			if verbose {
-				log.Printf("Client: Received event %s (kind %d) from relay", event.ID, event.Kind)
+		case <-writeClosed:
+			writeClosed = nil
+			if serverFinished {
+				return
 			}
-
-			// Check if this event is for us
-			if !IsEventForMe(event, clientPubkey) {
-				if verbose {
-					log.Printf("Client: Event %s not for us (our pubkey: %s)", event.ID, clientPubkey)
+		case pkt, ok := <-session.Incoming():
+			if !ok {
+				if err := session.Err(); err != nil {
+					// Reset the local socket so the connection handler stops reading
+					log.Printf("Client: Session %s - Session aborted: %v", sessionID, err)
+					resetConn(conn)
 				}
-				continue
+				return
 			}
 
-			// Version compatibility is now checked in UnwrapEphemeralGiftWrap
-
-			if verbose {
-				log.Printf("Client: Event %s is for us, attempting to unwrap", event.ID)
-			}
+			// Packets arrive reordered and deduplicated by the session
+			switch pkt.Type {
+			case PacketTypeData:
+				// Write data to client connection
+				if len(pkt.Packet.Data) > 0 {
+					if _, writeErr := conn.Write(pkt.Packet.Data); writeErr != nil {
+						log.Printf("Client: Session %s - Error writing to connection: %v", sessionID, writeErr)
+						// The local client is gone, so close the whole session
+						if err := session.Send(PacketTypeClose, nil); err != nil && err != ErrSessionClosed {
+							log.Printf("Client: Failed to send close packet: %v", err)
+						}
+						conn.Close()
+						return
+					}
 
-			// Parse encrypted gift wrapped event
-			parsedPacket, err := keyMgr.UnwrapEphemeralGiftWrap(event)
-			if err != nil {
-				if verbose {
-					log.Printf("Client: Error unwrapping encrypted event %s: %v", event.ID, err)
+					if verbose {
+						log.Printf("Client: Session %s - Received %d bytes from server (seq %d)", sessionID, len(pkt.Packet.Data), pkt.Sequence)
+					}
 				}
-				continue
-			}
-
-			// Check if this packet belongs to our session
-			if parsedPacket.SessionID != sessionID {
-				continue
-			}
-
-			// Check direction - we want server_to_client packets
-			if parsedPacket.Direction != "server_to_client" {
-				continue
-			}
 
-			// Skip if already processed
-			if processedSequences[parsedPacket.Sequence] {
-				continue
-			}
-
-			// Check sequence order - if not the next expected, buffer it
-			if parsedPacket.Sequence != nextExpectedSequence {
-				pendingPackets[parsedPacket.Sequence] = parsedPacket
+			case PacketTypeFin:
+				// The target finished sending; pass the half-close on to the local client
 				if verbose {
-					log.Printf("Client: Session %s - Buffering out-of-order packet seq %d (expecting %d)", sessionID, parsedPacket.Sequence, nextExpectedSequence)
+					log.Printf("Client: Session %s - Received fin packet from server", sessionID)
 				}
-				continue
-			}
-
-			// Process this packet and any consecutive buffered packets
-			packetsToProcess := []*ParsedPacket{parsedPacket}
-
-			// Collect consecutive packets from buffer
-			seq := nextExpectedSequence + 1
-			for {
-				if bufferedPacket, exists := pendingPackets[seq]; exists {
-					packetsToProcess = append(packetsToProcess, bufferedPacket)
-					delete(pendingPackets, seq)
-					seq++
-				} else {
-					break
+				if err := closeWrite(conn); err != nil && verbose {
+					log.Printf("Client: Session %s - Error half-closing connection: %v", sessionID, err)
 				}
-			}
-
-			// Process all packets in order
-			for _, pkt := range packetsToProcess {
-				// Mark as processed
-				processedSequences[pkt.Sequence] = true
-
-				// Process packet based on type
-				switch pkt.Type {
-				case PacketTypeData:
-					// Write data to client connection
-					if len(pkt.Packet.Data) > 0 {
-						if _, writeErr := conn.Write(pkt.Packet.Data); writeErr != nil {
-							log.Printf("Client: Session %s - Error writing to connection: %v", sessionID, writeErr)
-							return
-						}
-
-						if verbose {
-							log.Printf("Client: Session %s - Received %d bytes from server (seq %d)", sessionID, len(pkt.Packet.Data), pkt.Sequence)
-						}
-					}
-
-				case PacketTypeClose:
-					if verbose {
-						log.Printf("Client: Session %s - Received close packet from server", sessionID)
-					}
+				serverFinished = true
+				if writeClosed == nil {
 					return
 				}
 
-				// Update next expected sequence
-				nextExpectedSequence = pkt.Sequence + 1
+			case PacketTypeClose:
+				if pkt.ErrorMsg != "" {
+					// The tunnel failed, e.g. the server could not reach the target: reset the local connection
+					log.Printf("Client: Session %s - Server closed session with error: %s (%s)", sessionID, pkt.ErrorMsg, pkt.ErrorCode)
+					resetConn(conn)
+					return
+				}
+				if verbose {
+					log.Printf("Client: Session %s - Received close packet from server", sessionID)
+				}
+				conn.Close()
+				return
 			}
 		}
 	}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAwaitOpenAckTimesOut(t *testing.T) {
+	session := newUnansweredSession(t, DefaultSessionConfig())
+	if err := session.Send(PacketTypeOpen, nil, session.HandshakeTags()...); err != nil {
+		t.Fatalf("send open: %v", err)
+	}
+
+	start := time.Now()
+	if err := awaitOpenAck(session, 200*time.Millisecond); err == nil {
+		t.Fatal("awaitOpenAck accepted a session nobody answered")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("awaitOpenAck took %v with a 200ms deadline", elapsed)
+	}
+	if session.Err() == nil {
+		t.Error("session was not aborted")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Compression names a payload compression algorithm negotiated in the handshake
+type Compression string
+
+const (
+	CompressionNone    Compression = "none"
+	CompressionDeflate Compression = "deflate"
+)
+
+const (
+	minCompressSize     = 256         // Smaller chunks rarely shrink enough to pay for the tag
+	maxDecompressedSize = 1024 * 1024 // Larger than any chunk a sender produces; guards against decompression bombs
+)
+
+// flateWriters recycles deflate writers, which allocate several hundred KB each
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return writer
+	},
+}
+
+// ParseCompression validates a compression name from the command line
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case CompressionNone, CompressionDeflate:
+		return Compression(name), nil
+	}
+	return "", fmt.Errorf("unknown compression %q (use deflate or none)", name)
+}
+
+// encodingTag marks data compressed with the given algorithm
+func encodingTag(compression Compression) nostr.Tag {
+	return nostr.Tag{"encoding", string(compression)}
+}
+
+// compressChunk compresses data with deflate and reports false, leaving data to be sent as is,
+// when the chunk is too small or does not get smaller
+func compressChunk(data []byte) ([]byte, bool) {
+	if len(data) < minCompressSize {
+		return nil, false
+	}
+
+	var compressed bytes.Buffer
+	writer := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(writer)
+	writer.Reset(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return nil, false
+	}
+	if err := writer.Close(); err != nil {
+		return nil, false
+	}
+
+	if compressed.Len() >= len(data) {
+		return nil, false
+	}
+	return compressed.Bytes(), true
+}
+
+// decompressChunk reverses the encoding announced by a data packet
+func decompressChunk(encoding Compression, data []byte) ([]byte, error) {
+	if encoding != CompressionDeflate {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %v", err)
+	}
+	if len(decompressed) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", maxDecompressedSize)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"testing"
+)
+
+// deflate compresses data without compressChunk's size checks
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	writer.Write(data)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+func TestCompressChunk(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		wantCompress bool
+	}{
+		{"too small", bytes.Repeat([]byte("a"), minCompressSize-1), false},
+		{"compressible", bytes.Repeat([]byte("hello world "), 100), true},
+		{"incompressible", random, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, ok := compressChunk(tt.data)
+			if ok != tt.wantCompress {
+				t.Fatalf("compressChunk compressed %v, want %v", ok, tt.wantCompress)
+			}
+			if !ok {
+				return
+			}
+			if len(compressed) >= len(tt.data) {
+				t.Errorf("compressed to %d bytes from %d", len(compressed), len(tt.data))
+			}
+			decompressed, err := decompressChunk(CompressionDeflate, compressed)
+			if err != nil {
+				t.Fatalf("decompressChunk: %v", err)
+			}
+			if !bytes.Equal(decompressed, tt.data) {
+				t.Error("round trip changed the data")
+			}
+		})
+	}
+}
+
+func TestDecompressChunkLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding Compression
+		data     []byte
+		wantErr  bool
+	}{
+		{"at limit", CompressionDeflate, deflate(t, make([]byte, maxDecompressedSize)), false},
+		{"bomb", CompressionDeflate, deflate(t, make([]byte, maxDecompressedSize+1)), true},
+		{"corrupt", CompressionDeflate, []byte{0xff, 0xff, 0xff}, true},
+		{"unknown encoding", Compression("gzip"), deflate(t, []byte("x")), true},
+		{"none is not an encoding", CompressionNone, []byte("x"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decompressChunk(tt.encoding, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decompressChunk error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
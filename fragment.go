@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/bits"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip44"
+)
+
+// Event size budgeting
+const (
+	defaultMaxEventSize  = 64 * 1024       // Largest relay message we produce unless configured or advertised lower
+	minMaxEventSize      = 4 * 1024        // Below this the fixed overhead leaves too little room for data
+	giftWrapOverhead     = 512             // ["EVENT", ...] framing, id, pubkey, sig, tags and JSON keys of a gift wrap
+	nip44Overhead        = 1 + 32 + 2 + 32 // Version, nonce, length prefix and MAC around the padded plaintext
+	rumorHeaderAllowance = 1536            // Rumor JSON without content: keys, ids, signature and a worst-case set of tags
+	relayInfoTimeout     = 5 * time.Second // How long to wait for a relay's NIP-11 document
+)
+
+// discoverMaxEventSize lowers maxEventSize to the smallest message limit advertised by the
+// relays in their NIP-11 documents. Relays that don't answer or advertise no limit are ignored
+func discoverMaxEventSize(relayURLs []string, maxEventSize int, verbose bool) int {
+	for _, relayURL := range relayURLs {
+		ctx, cancel := context.WithTimeout(context.Background(), relayInfoTimeout)
+		info, err := nip11.Fetch(ctx, relayURL)
+		cancel()
+		if err != nil || info.Limitation == nil {
+			if verbose {
+				log.Printf("Nostr: No size limits advertised by %s: %v", relayURL, err)
+			}
+			continue
+		}
+
+		limit := info.Limitation.MaxMessageLength
+		if contentLimit := info.Limitation.MaxContentLength; contentLimit > 0 && (limit <= 0 || contentLimit+giftWrapOverhead < limit) {
+			limit = contentLimit + giftWrapOverhead
+		}
+		if limit <= 0 {
+			continue
+		}
+		if verbose {
+			log.Printf("Nostr: Relay %s accepts messages up to %d bytes", relayURL, limit)
+		}
+		if limit < maxEventSize {
+			maxEventSize = limit
+		}
+	}
+
+	if maxEventSize < minMaxEventSize {
+		log.Printf("Nostr: Relays advertise a message limit below %d bytes; using %d anyway", minMaxEventSize, minMaxEventSize)
+		maxEventSize = minMaxEventSize
+	}
+	return maxEventSize
+}
+
+// nip44PaddedLen returns the padded length NIP-44 uses for a plaintext of n bytes
+func nip44PaddedLen(n int) int {
+	if n <= 32 {
+		return 32
+	}
+	nextPower := 1 << bits.Len(uint(n-1))
+	chunk := 32
+	if nextPower/8 > chunk {
+		chunk = nextPower / 8
+	}
+	return chunk * ((n-1)/chunk + 1)
+}
+
+// maxRumorSize returns the largest serialized rumor that fits in one gift wrap of at most
+// maxEventSize bytes
+func maxRumorSize(maxEventSize int) int {
+	// The NIP-44 payload is base64 encoded into the gift wrap content
+	payload := (maxEventSize - giftWrapOverhead) / 4 * 3
+	ciphertext := payload - nip44Overhead
+
+	// Largest plaintext whose padded length still fits
+	low, high := 0, nip44.MaxPlaintextSize
+	for low < high {
+		mid := (low + high + 1) / 2
+		if nip44PaddedLen(mid) <= ciphertext {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low
+}
+
+// maxFragmentData returns how many bytes of TCP data fit in one gift wrap of at most
+// maxEventSize bytes when the rumor is serialized in the given format
+func maxFragmentData(maxEventSize int, format RumorFormat) int {
+	data := maxRumorSize(maxEventSize) - rumorHeaderAllowance
+	if format != RumorFormatBinary {
+		// JSON rumors carry the data base64 encoded in their content
+		data = data / 4 * 3
+	}
+	if data < 1 {
+		return 1
+	}
+	return data
+}
+
+// fragmentTag marks fragment index of count of one chunk; the receiver joins them back together
+func fragmentTag(index, count int) nostr.Tag {
+	return nostr.Tag{"frag", strconv.Itoa(index), strconv.Itoa(count)}
+}
+
+// reassembler joins consecutive fragments delivered in order back into the original chunk.
+// Delivery is reliable and in order, so a chunk that doesn't arrive whole and consecutive
+// means the peer broke the protocol
+type reassembler struct {
+	first *ParsedPacket
+	data  []byte
+	next  int // Index of the fragment expected next
+}
+
+// add takes the next in-order packet and returns the packet to deliver, or nil while a chunk
+// is incomplete. Packets other than data are passed on, since an aborting sender may
+// interleave its close with the fragments of a chunk
+func (r *reassembler) add(pkt *ParsedPacket) (*ParsedPacket, error) {
+	if pkt.Type != PacketTypeData {
+		return pkt, nil
+	}
+
+	if pkt.FragmentCount <= 1 {
+		if r.first != nil {
+			return nil, fmt.Errorf("unfragmented data seq %d inside a chunk of %d fragments", pkt.Sequence, r.first.FragmentCount)
+		}
+		return pkt, nil
+	}
+
+	switch {
+	case r.first == nil && pkt.FragmentIndex != 0:
+		return nil, fmt.Errorf("fragment %d of %d at seq %d without the start of its chunk", pkt.FragmentIndex, pkt.FragmentCount, pkt.Sequence)
+	case r.first != nil && pkt.FragmentCount != r.first.FragmentCount:
+		return nil, fmt.Errorf("fragment count changed from %d to %d at seq %d", r.first.FragmentCount, pkt.FragmentCount, pkt.Sequence)
+	case r.first != nil && pkt.FragmentIndex != r.next:
+		return nil, fmt.Errorf("fragment %d at seq %d where fragment %d was expected", pkt.FragmentIndex, pkt.Sequence, r.next)
+	}
+
+	if pkt.FragmentIndex == 0 {
+		r.first = pkt
+		r.data = append([]byte(nil), pkt.Packet.Data...)
+	} else {
+		r.data = append(r.data, pkt.Packet.Data...)
+	}
+	r.next = pkt.FragmentIndex + 1
+
+	if r.next < pkt.FragmentCount {
+		return nil, nil
+	}
+
+	whole := *r.first
+	whole.Packet = &Packet{Data: r.data}
+	whole.Sequence = pkt.Sequence
+	r.first, r.data, r.next = nil, nil, 0
+	return &whole, nil
+}
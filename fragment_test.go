@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fragment returns a data packet carrying part index of count
+func fragment(seq uint64, index, count int, data string) *ParsedPacket {
+	return &ParsedPacket{Packet: NewPacket([]byte(data)), Type: PacketTypeData, Sequence: seq, FragmentIndex: index, FragmentCount: count}
+}
+
+func TestReassembler(t *testing.T) {
+	closePacket := &ParsedPacket{Packet: NewPacket(nil), Type: PacketTypeClose, Sequence: 2}
+
+	tests := []struct {
+		name    string
+		packets []*ParsedPacket
+		want    []string // Data of every delivered packet, in order
+		wantSeq uint64   // Sequence of the last delivered packet
+		wantErr bool
+	}{
+		{
+			name:    "unfragmented",
+			packets: []*ParsedPacket{fragment(1, 0, 0, "abc")},
+			want:    []string{"abc"},
+			wantSeq: 1,
+		},
+		{
+			name:    "whole chunk",
+			packets: []*ParsedPacket{fragment(1, 0, 3, "ab"), fragment(2, 1, 3, "cd"), fragment(3, 2, 3, "e")},
+			want:    []string{"abcde"},
+			wantSeq: 3,
+		},
+		{
+			name:    "consecutive chunks",
+			packets: []*ParsedPacket{fragment(1, 0, 2, "ab"), fragment(2, 1, 2, "c"), fragment(3, 0, 2, "de"), fragment(4, 1, 2, "f")},
+			want:    []string{"abc", "def"},
+			wantSeq: 4,
+		},
+		{
+			name:    "incomplete",
+			packets: []*ParsedPacket{fragment(1, 0, 3, "ab"), fragment(2, 1, 3, "cd")},
+			want:    nil,
+		},
+		{
+			name:    "close inside a chunk passed on",
+			packets: []*ParsedPacket{fragment(1, 0, 2, "ab"), closePacket},
+			want:    []string{""},
+			wantSeq: 2,
+		},
+		{
+			name:    "unfragmented inside a chunk",
+			packets: []*ParsedPacket{fragment(1, 0, 2, "ab"), fragment(2, 0, 1, "x")},
+			wantErr: true,
+		},
+		{
+			name:    "missing start",
+			packets: []*ParsedPacket{fragment(5, 1, 2, "cd")},
+			wantErr: true,
+		},
+		{
+			name:    "restart inside a chunk",
+			packets: []*ParsedPacket{fragment(1, 0, 2, "ab"), fragment(2, 0, 2, "xy")},
+			wantErr: true,
+		},
+		{
+			name:    "skipped index",
+			packets: []*ParsedPacket{fragment(1, 0, 3, "ab"), fragment(2, 2, 3, "cd")},
+			wantErr: true,
+		},
+		{
+			name:    "count changed",
+			packets: []*ParsedPacket{fragment(1, 0, 3, "ab"), fragment(2, 1, 2, "cd")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r reassembler
+			var got []string
+			var last *ParsedPacket
+			var err error
+			for _, pkt := range tt.packets {
+				var whole *ParsedPacket
+				if whole, err = r.add(pkt); err != nil {
+					break
+				}
+				if whole != nil {
+					got = append(got, string(whole.Packet.Data))
+					last = whole
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("add error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("delivered %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("delivered %q, want %q", got, tt.want)
+					break
+				}
+			}
+			if last != nil && last.Sequence != tt.wantSeq {
+				t.Errorf("last sequence %d, want %d", last.Sequence, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestReassemblerDoesNotAliasFragments(t *testing.T) {
+	var r reassembler
+	first := fragment(1, 0, 2, "ab")
+	r.add(first)
+	whole, err := r.add(fragment(2, 1, 2, "cd"))
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if !bytes.Equal(first.Packet.Data, []byte("ab")) {
+		t.Errorf("first fragment changed to %q", first.Packet.Data)
+	}
+	if string(whole.Packet.Data) != "abcd" {
+		t.Errorf("delivered %q, want %q", whole.Packet.Data, "abcd")
+	}
+}
+
+func TestMaxFragmentDataFitsEvent(t *testing.T) {
+	sender := newTestKeyManager(t)
+	recipient := newTestKeyManager(t)
+	// A generous set of the tags a data packet can carry besides the fixed ones
+	tags := []nostr.Tag{
+		fragmentTag(999, 1000),
+		{"ack", "18446744073709551615", "18446744073709551614", "18446744073709551613", "18446744073709551612"},
+		{"window", "1048576"},
+		encodingTag(CompressionDeflate),
+	}
+
+	for _, maxEventSize := range []int{minMaxEventSize, 16 * 1024, defaultMaxEventSize, 128 * 1024} {
+		for _, format := range []RumorFormat{RumorFormatJSON, RumorFormatBinary} {
+			data := make([]byte, maxFragmentData(maxEventSize, format))
+			event, err := sender.CreateEphemeralGiftWrappedEvent(NewPacket(data), recipient.GetKeys().PublicKey, PacketTypeData, "0123456789abcdef", 18446744073709551615, "client_to_server", "", 0, "", "", format, nil, tags...)
+			if err != nil {
+				t.Fatalf("%d/%s: %v", maxEventSize, format, err)
+			}
+			envelope, err := json.Marshal([]interface{}{"EVENT", event})
+			if err != nil {
+				t.Fatalf("%d/%s: %v", maxEventSize, format, err)
+			}
+			if len(envelope) > maxEventSize {
+				t.Errorf("%d/%s: %d bytes of data make a %d byte message", maxEventSize, format, len(data), len(envelope))
+			}
+		}
+	}
+}
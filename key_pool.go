@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+)
+
+// Defaults of the one-time key pool
+const (
+	defaultKeyPoolSize = 1000 // Keys generated ahead of use
+	defaultKeyMaxUses  = 1    // Gift wraps signed with one key before it is retired
+)
+
+// oneTimeKey is a pool key signing up to maxUses gift wraps. Conversation keys are
+// derived on first use per target and kept for the key's remaining uses
+type oneTimeKey struct {
+	KeyPair
+
+	uses             int // Guarded by KeyManager.keyMutex
+	mutex            sync.Mutex
+	conversationKeys map[string][32]byte
+}
+
+// conversationKey returns the NIP-44 conversation key between this key and targetPubkey
+func (otk *oneTimeKey) conversationKey(targetPubkey string) ([32]byte, error) {
+	otk.mutex.Lock()
+	defer otk.mutex.Unlock()
+
+	if key, exists := otk.conversationKeys[targetPubkey]; exists {
+		return key, nil
+	}
+	key, err := nip44.GenerateConversationKey(targetPubkey, otk.PrivateKey)
+	if err != nil {
+		return key, err
+	}
+	if otk.conversationKeys == nil {
+		otk.conversationKeys = make(map[string][32]byte)
+	}
+	otk.conversationKeys[targetPubkey] = key
+	return key, nil
+}
+
+// generateOneTimeKey creates a fresh keypair for the pool
+func generateOneTimeKey() (*oneTimeKey, error) {
+	privKey := nostr.GeneratePrivateKey()
+	pubKey, err := nostr.GetPublicKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate one-time key: %v", err)
+	}
+	return &oneTimeKey{KeyPair: KeyPair{PrivateKey: privKey, PublicKey: pubKey}}, nil
+}
+
+// startKeyPool starts the goroutine that keeps the pool of unused one-time keys full
+func (km *KeyManager) startKeyPool(poolSize, maxUses int) {
+	km.keyPool = make(chan *oneTimeKey, poolSize)
+	km.keyMaxUses = maxUses
+	km.keyPoolStop = make(chan struct{})
+	go km.fillKeyPool()
+
+	log.Printf("Filling one-time key pool of %d keys in the background (each key signs at most %d gift wrap(s))", poolSize, maxUses)
+}
+
+// fillKeyPool generates keys whenever the pool has room, until the key manager is closed
+func (km *KeyManager) fillKeyPool() {
+	for {
+		key, err := generateOneTimeKey()
+		if err != nil {
+			log.Printf("Nostr: %v", err)
+			continue
+		}
+
+		select {
+		case km.keyPool <- key:
+		case <-km.keyPoolStop:
+			return
+		}
+	}
+}
+
+// nextOneTimeKey returns the key for the next gift wrap. A key is retired once it has been used
+// maxUses times and replaced from the pool; if the pool is empty a key is generated inline
+func (km *KeyManager) nextOneTimeKey() (*oneTimeKey, error) {
+	km.keyMutex.Lock()
+	defer km.keyMutex.Unlock()
+
+	if km.currentKey == nil || km.currentKey.uses >= km.keyMaxUses {
+		select {
+		case key := <-km.keyPool:
+			km.currentKey = key
+		default:
+			// Sending faster than the pool refills
+			key, err := generateOneTimeKey()
+			if err != nil {
+				return nil, err
+			}
+			km.currentKey = key
+			km.keyPoolMisses++
+		}
+	}
+
+	km.currentKey.uses++
+	return km.currentKey, nil
+}
+
+// KeyPoolStats returns how many unused keys are ready and how many keys had to be generated inline
+func (km *KeyManager) KeyPoolStats() (int, uint64) {
+	km.keyMutex.Lock()
+	defer km.keyMutex.Unlock()
+	return len(km.keyPool), km.keyPoolMisses
+}
+
+// Close stops refilling the one-time key pool
+func (km *KeyManager) Close() {
+	km.keyPoolStopOnce.Do(func() { close(km.keyPoolStop) })
+}
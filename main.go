@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // getFlagOrEnv gets a value from flag first, or falls back to environment variable with TON_ prefix
@@ -52,6 +53,21 @@ func getFlagOrEnvInt(flagValue int, envName, flagName string) int {
 	return flagValue
 }
 
+// getFlagOrEnvDuration gets a duration value from flag first, or falls back to environment variable with TON_ prefix
+func getFlagOrEnvDuration(flagValue time.Duration, envName, flagName string) time.Duration {
+	// Check if the flag was actually set by the user
+	if isFlagSet(flagName) {
+		return flagValue
+	}
+	// Fall back to environment variable
+	if envValue := os.Getenv("TON_" + envName); envValue != "" {
+		if parsed, err := time.ParseDuration(envValue); err == nil {
+			return parsed
+		}
+	}
+	return flagValue
+}
+
 // isFlagSet checks if a flag was actually set by the user
 func isFlagSet(flagName string) bool {
 	set := false
@@ -65,10 +81,11 @@ func isFlagSet(flagName string) bool {
 
 func main() {
 	// Mode selection
-	var mode = flag.String("mode", "", "Mode to run: 'client' or 'server' (required)")
+	var mode = flag.String("mode", "", "Mode to run: 'client', 'server' or 'bench' (required)")
 
 	// Client flags
 	var clientPort = flag.Int("client-port", 8080, "Port for client to listen on")
+	var forwardClientAddr = flag.Bool("forward-client-addr", false, "Tell the server the address of each local client connection")
 
 	// Server flags
 	var targetHost = flag.String("target-host", "localhost", "Target host to proxy to")
@@ -78,6 +95,29 @@ func main() {
 	var relay = flag.String("relay", "ws://localhost:10547", "Nostr relay URL for event communication (can specify multiple with -relay flag)")
 	var serverKey = flag.String("server-key", "", "Server's Nostr public key (required for client)")
 	var privateKey = flag.String("private-key", "", "Private key in hex or nsec format (if not provided, keys will be generated)")
+	var keyPoolSize = flag.Int("key-pool-size", defaultKeyPoolSize, "One-time keys generated ahead of use in the background")
+	var keyMaxUses = flag.Int("key-max-uses", defaultKeyMaxUses, "Gift wraps signed with one one-time key before it is retired")
+	var replayWindow = flag.Duration("replay-window", defaultReplayWindow, "Reject received events timestamped further than this from our clock, or received before")
+	var allowedClients = flag.String("allowed-clients", "", "Client pubkeys (hex or npub) allowed to open sessions, comma-separated or a file with one per line (server only, default any)")
+
+	// Session flags
+	defaultSessionConfig := DefaultSessionConfig()
+	var gapTimeout = flag.Duration("gap-timeout", defaultSessionConfig.GapTimeout, "How long a missing packet may hold back buffered packets before the session is aborted")
+	var maxBufferedBytes = flag.Int("max-buffered-bytes", defaultSessionConfig.MaxBufferedBytes, "Out-of-order bytes buffered per session before it is aborted")
+	var heartbeatInterval = flag.Duration("heartbeat-interval", defaultSessionConfig.HeartbeatInterval, "Idle time after which a session sends a heartbeat to its peer")
+	var peerTimeout = flag.Duration("peer-timeout", defaultSessionConfig.PeerTimeout, "Silence from the peer after which a session is suspended")
+	var resumeGrace = flag.Duration("resume-grace", defaultSessionConfig.ResumeGrace, "How long a suspended session waits for the peer to come back before it is closed (0 closes right away)")
+	var coalesceDelay = flag.Duration("coalesce-delay", defaultSessionConfig.CoalesceDelay, "How long small writes may wait to be sent together while data is in flight")
+	var coalesceSize = flag.Int("coalesce-size", defaultSessionConfig.CoalesceSize, "Bytes of coalesced data sent as one packet (0 fills one event)")
+	var noDelay = flag.Bool("no-delay", false, "Send every write immediately without coalescing, for latency-sensitive tunnels")
+	var compression = flag.String("compression", string(defaultSessionConfig.Compression), "Payload compression offered to the peer: deflate or none")
+	var paddingBuckets = flag.String("padding-buckets", "none", "Comma-separated rumor sizes in bytes that events are padded to, or none")
+	var coverInterval = flag.Duration("cover-interval", 0, "Send a dummy event this often on every session to mask traffic patterns (0 disables)")
+	// Bench flags
+	var benchSize = flag.Int("bench-size", defaultBenchSize, "Bytes transferred in each direction by the bench mode")
+	var benchPings = flag.Int("bench-pings", defaultBenchPings, "Round trips timed by the bench mode")
+
+	var maxEventSize = flag.Int("max-event-size", defaultSessionConfig.MaxEventSize, "Largest event in bytes sent to relays; bigger packets are fragmented (lowered further to relay-advertised limits)")
 
 	var verbose = flag.Bool("verbose", false, "Enable verbose logging")
 	var version = flag.Bool("version", false, "Show version information")
@@ -87,11 +127,30 @@ func main() {
 	// Use flag values first, fall back to environment variables if flags are not set
 	*mode = getFlagOrEnv(*mode, "MODE", "mode")
 	*clientPort = getFlagOrEnvInt(*clientPort, "CLIENT_PORT", "client-port")
+	*forwardClientAddr = getFlagOrEnvBool(*forwardClientAddr, "FORWARD_CLIENT_ADDR", "forward-client-addr")
 	*targetHost = getFlagOrEnv(*targetHost, "TARGET_HOST", "target-host")
 	*targetPort = getFlagOrEnvInt(*targetPort, "TARGET_PORT", "target-port")
 	*relay = getFlagOrEnv(*relay, "RELAY", "relay")
 	*serverKey = getFlagOrEnv(*serverKey, "SERVER_KEY", "server-key")
 	*privateKey = getFlagOrEnv(*privateKey, "PRIVATE_KEY", "private-key")
+	*keyPoolSize = getFlagOrEnvInt(*keyPoolSize, "KEY_POOL_SIZE", "key-pool-size")
+	*keyMaxUses = getFlagOrEnvInt(*keyMaxUses, "KEY_MAX_USES", "key-max-uses")
+	*replayWindow = getFlagOrEnvDuration(*replayWindow, "REPLAY_WINDOW", "replay-window")
+	*allowedClients = getFlagOrEnv(*allowedClients, "ALLOWED_CLIENTS", "allowed-clients")
+	*gapTimeout = getFlagOrEnvDuration(*gapTimeout, "GAP_TIMEOUT", "gap-timeout")
+	*maxBufferedBytes = getFlagOrEnvInt(*maxBufferedBytes, "MAX_BUFFERED_BYTES", "max-buffered-bytes")
+	*heartbeatInterval = getFlagOrEnvDuration(*heartbeatInterval, "HEARTBEAT_INTERVAL", "heartbeat-interval")
+	*peerTimeout = getFlagOrEnvDuration(*peerTimeout, "PEER_TIMEOUT", "peer-timeout")
+	*resumeGrace = getFlagOrEnvDuration(*resumeGrace, "RESUME_GRACE", "resume-grace")
+	*maxEventSize = getFlagOrEnvInt(*maxEventSize, "MAX_EVENT_SIZE", "max-event-size")
+	*coalesceDelay = getFlagOrEnvDuration(*coalesceDelay, "COALESCE_DELAY", "coalesce-delay")
+	*coalesceSize = getFlagOrEnvInt(*coalesceSize, "COALESCE_SIZE", "coalesce-size")
+	*noDelay = getFlagOrEnvBool(*noDelay, "NO_DELAY", "no-delay")
+	*compression = getFlagOrEnv(*compression, "COMPRESSION", "compression")
+	*paddingBuckets = getFlagOrEnv(*paddingBuckets, "PADDING_BUCKETS", "padding-buckets")
+	*coverInterval = getFlagOrEnvDuration(*coverInterval, "COVER_INTERVAL", "cover-interval")
+	*benchSize = getFlagOrEnvInt(*benchSize, "BENCH_SIZE", "bench-size")
+	*benchPings = getFlagOrEnvInt(*benchPings, "BENCH_PINGS", "bench-pings")
 	*verbose = getFlagOrEnvBool(*verbose, "VERBOSE", "verbose")
 	*version = getFlagOrEnvBool(*version, "VERSION", "version")
 
@@ -148,28 +207,65 @@ func main() {
 		fmt.Fprintf(os.Stderr, "%s\n", GetVersionInfo())
 		fmt.Fprintf(os.Stderr, "Decentralized TCP Proxy over Nostr Protocol\n")
 		fmt.Fprintf(os.Stderr, "%s\n\n", GetCopyrightInfo())
-		fmt.Fprintf(os.Stderr, "Usage: %s -mode <client|server> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -mode <client|server|bench> [options]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Modes:\n")
 		fmt.Fprintf(os.Stderr, "  client: Accept TCP connections and forward data via Nostr events\n")
-		fmt.Fprintf(os.Stderr, "  server: Receive Nostr events and connect to target host\n\n")
+		fmt.Fprintf(os.Stderr, "  server: Receive Nostr events and connect to target host\n")
+		fmt.Fprintf(os.Stderr, "  bench:  Run a client and server in one process and measure latency and throughput over the relays\n\n")
 		fmt.Fprintf(os.Stderr, "Environment Variables:\n")
 		fmt.Fprintf(os.Stderr, "  All command line parameters can also be provided as environment variables\n")
 		fmt.Fprintf(os.Stderr, "  with TON_ prefix (e.g., TON_MODE, TON_CLIENT_PORT, TON_SERVER_KEY, etc.)\n")
 		fmt.Fprintf(os.Stderr, "  Command line flags take precedence over environment variables.\n\n")
 		fmt.Fprintf(os.Stderr, "Client mode options:\n")
 		fmt.Fprintf(os.Stderr, "  -client-port int     Port for client to listen on (default 8080)\n")
+		fmt.Fprintf(os.Stderr, "  -forward-client-addr  Tell the server the address of each local client connection\n")
 		fmt.Fprintf(os.Stderr, "  -server-key string   Server's Nostr public key in hex or npub format (required)\n")
 		fmt.Fprintf(os.Stderr, "  -private-key string  Private key in hex or nsec format (if not provided, keys will be generated)\n")
+		fmt.Fprintf(os.Stderr, "  -key-pool-size int   One-time keys generated ahead of use in the background (default 1000)\n")
+		fmt.Fprintf(os.Stderr, "  -key-max-uses int    Gift wraps signed with one one-time key before it is retired (default 1)\n")
+		fmt.Fprintf(os.Stderr, "  -replay-window duration  Reject events timestamped further than this from our clock, or received before (default 5m0s)\n")
 		fmt.Fprintf(os.Stderr, "  -relay string        Nostr relay URL (can specify multiple times or comma-separated, default \"ws://localhost:10547\")\n")
+		fmt.Fprintf(os.Stderr, "  -gap-timeout duration  Abort a session when a missing packet holds back data this long (default 30s)\n")
+		fmt.Fprintf(os.Stderr, "  -max-buffered-bytes int  Abort a session when this many bytes are buffered out of order (default 4194304)\n")
+		fmt.Fprintf(os.Stderr, "  -heartbeat-interval duration  Send a heartbeat after this much idle time (default 15s)\n")
+		fmt.Fprintf(os.Stderr, "  -peer-timeout duration  Suspend a session when the peer is silent this long (default 1m0s)\n")
+		fmt.Fprintf(os.Stderr, "  -resume-grace duration  Close a suspended session if the peer is not back within this time (default 5m0s)\n")
+		fmt.Fprintf(os.Stderr, "  -max-event-size int  Fragment packets into events of at most this many bytes (default 65536)\n")
+		fmt.Fprintf(os.Stderr, "  -coalesce-delay duration  Let small writes wait this long to be sent together while data is in flight (default 20ms)\n")
+		fmt.Fprintf(os.Stderr, "  -coalesce-size int   Send coalesced data once this many bytes are collected, at most 1048576 (default 0, one full event)\n")
+		fmt.Fprintf(os.Stderr, "  -no-delay           Send every write immediately without coalescing\n")
+		fmt.Fprintf(os.Stderr, "  -compression string  Compress data when the peer supports it: deflate or none (default \"deflate\")\n")
+		fmt.Fprintf(os.Stderr, "  -padding-buckets string  Pad events to the smallest of these sizes in bytes, e.g. 1024,8192,32768 (default \"none\")\n")
+		fmt.Fprintf(os.Stderr, "  -cover-interval duration  Send a dummy event this often on every session (default 0, disabled)\n")
 		fmt.Fprintf(os.Stderr, "  -verbose            Enable verbose logging\n")
 		fmt.Fprintf(os.Stderr, "  -version            Show version information\n\n")
 		fmt.Fprintf(os.Stderr, "Server mode options:\n")
 		fmt.Fprintf(os.Stderr, "  -target-host string  Target host to proxy to (default \"localhost\") or host:port format\n")
 		fmt.Fprintf(os.Stderr, "  -target-port int     Target port to proxy to (default 80, ignored if host:port format used)\n")
+		fmt.Fprintf(os.Stderr, "  -allowed-clients string  Client pubkeys allowed to open sessions, comma-separated or a file with one per line (default any)\n")
 		fmt.Fprintf(os.Stderr, "  -private-key string  Private key in hex or nsec format (if not provided, keys will be generated)\n")
+		fmt.Fprintf(os.Stderr, "  -key-pool-size int   One-time keys generated ahead of use in the background (default 1000)\n")
+		fmt.Fprintf(os.Stderr, "  -key-max-uses int    Gift wraps signed with one one-time key before it is retired (default 1)\n")
+		fmt.Fprintf(os.Stderr, "  -replay-window duration  Reject events timestamped further than this from our clock, or received before (default 5m0s)\n")
 		fmt.Fprintf(os.Stderr, "  -relay string        Nostr relay URL (can specify multiple times or comma-separated, default \"ws://localhost:10547\")\n")
+		fmt.Fprintf(os.Stderr, "  -gap-timeout duration  Abort a session when a missing packet holds back data this long (default 30s)\n")
+		fmt.Fprintf(os.Stderr, "  -max-buffered-bytes int  Abort a session when this many bytes are buffered out of order (default 4194304)\n")
+		fmt.Fprintf(os.Stderr, "  -heartbeat-interval duration  Send a heartbeat after this much idle time (default 15s)\n")
+		fmt.Fprintf(os.Stderr, "  -peer-timeout duration  Suspend a session when the peer is silent this long (default 1m0s)\n")
+		fmt.Fprintf(os.Stderr, "  -resume-grace duration  Close a suspended session if the peer is not back within this time (default 5m0s)\n")
+		fmt.Fprintf(os.Stderr, "  -max-event-size int  Fragment packets into events of at most this many bytes (default 65536)\n")
+		fmt.Fprintf(os.Stderr, "  -coalesce-delay duration  Let small writes wait this long to be sent together while data is in flight (default 20ms)\n")
+		fmt.Fprintf(os.Stderr, "  -coalesce-size int   Send coalesced data once this many bytes are collected, at most 1048576 (default 0, one full event)\n")
+		fmt.Fprintf(os.Stderr, "  -no-delay           Send every write immediately without coalescing\n")
+		fmt.Fprintf(os.Stderr, "  -compression string  Compress data when the peer supports it: deflate or none (default \"deflate\")\n")
+		fmt.Fprintf(os.Stderr, "  -padding-buckets string  Pad events to the smallest of these sizes in bytes, e.g. 1024,8192,32768 (default \"none\")\n")
+		fmt.Fprintf(os.Stderr, "  -cover-interval duration  Send a dummy event this often on every session (default 0, disabled)\n")
 		fmt.Fprintf(os.Stderr, "  -verbose            Enable verbose logging\n")
 		fmt.Fprintf(os.Stderr, "  -version            Show version information\n\n")
+		fmt.Fprintf(os.Stderr, "Bench mode options (plus the session and key options above):\n")
+		fmt.Fprintf(os.Stderr, "  -relay string        Nostr relay URL (can specify multiple times or comma-separated, default \"ws://localhost:10547\")\n")
+		fmt.Fprintf(os.Stderr, "  -bench-size int      Bytes transferred in each direction (default 4194304)\n")
+		fmt.Fprintf(os.Stderr, "  -bench-pings int     Round trips timed for the latency report (default 50)\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  # Start server (shows pubkey for client) - separate host and port\n")
 		fmt.Fprintf(os.Stderr, "  %s -mode server -target-host httpbin.org -target-port 80 -relay ws://relay.damus.io\n\n", os.Args[0])
@@ -183,6 +279,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s -mode server -target-host 192.168.1.100:22\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -mode client -server-key <pubkey> -client-port 2222\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  ssh -p 2222 user@localhost\n\n")
+		fmt.Fprintf(os.Stderr, "  # Measure what a relay set sustains\n")
+		fmt.Fprintf(os.Stderr, "  %s -mode bench -relay wss://relay.damus.io,wss://nos.lol\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "For more information:\n")
 		fmt.Fprintf(os.Stderr, "  Version: %s --version\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  License: %s\n\n", License)
@@ -211,12 +309,90 @@ func main() {
 		log.Fatal("Client mode requires -server-key parameter")
 	}
 
+	if *gapTimeout <= 0 || *maxBufferedBytes <= 0 {
+		log.Fatal("gap-timeout and max-buffered-bytes must be positive")
+	}
+
+	if *heartbeatInterval <= 0 {
+		log.Fatal("heartbeat-interval must be positive")
+	}
+	if *peerTimeout <= *heartbeatInterval {
+		log.Fatal("peer-timeout must be longer than heartbeat-interval")
+	}
+
+	if *resumeGrace < 0 {
+		log.Fatal("resume-grace must not be negative")
+	}
+
+	if *maxEventSize < minMaxEventSize {
+		log.Fatalf("max-event-size must be at least %d", minMaxEventSize)
+	}
+
+	if *coalesceDelay < 0 || *coalesceSize < 0 {
+		log.Fatal("coalesce-delay and coalesce-size must not be negative")
+	}
+	if *coalesceSize > maxDecompressedSize {
+		// Compressed chunks larger than this are refused by the peer
+		log.Fatalf("coalesce-size must not exceed %d", maxDecompressedSize)
+	}
+	if *noDelay {
+		*coalesceDelay = 0
+	}
+
+	if *keyPoolSize < 1 || *keyMaxUses < 1 {
+		log.Fatal("key-pool-size and key-max-uses must be at least 1")
+	}
+
+	if *replayWindow <= 0 {
+		log.Fatal("replay-window must be positive")
+	}
+
+	if *coverInterval < 0 {
+		log.Fatal("cover-interval must not be negative")
+	}
+
+	if *mode == "bench" && (*benchSize < 1 || *benchPings < 1) {
+		log.Fatal("bench-size and bench-pings must be at least 1")
+	}
+
+	sessionCompression, err := ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sessionPadding, err := ParsePaddingBuckets(*paddingBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clientAllowlist, err := LoadClientAllowlist(*allowedClients)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sessionConfig := &SessionConfig{
+		GapTimeout:        *gapTimeout,
+		MaxBufferedBytes:  *maxBufferedBytes,
+		HeartbeatInterval: *heartbeatInterval,
+		PeerTimeout:       *peerTimeout,
+		ResumeGrace:       *resumeGrace,
+		MaxEventSize:      *maxEventSize,
+		CoalesceDelay:     *coalesceDelay,
+		CoalesceSize:      *coalesceSize,
+		Compression:       sessionCompression,
+		ForwardClientAddr: *forwardClientAddr,
+		PaddingBuckets:    sessionPadding,
+		CoverInterval:     *coverInterval,
+	}
+
 	switch *mode {
 	case "client":
-		runClientNostr(*clientPort, relayURLs, *serverKey, *privateKey, *verbose)
+		runClientNostr(*clientPort, relayURLs, *serverKey, *privateKey, *keyPoolSize, *keyMaxUses, *replayWindow, sessionConfig, *verbose)
 	case "server":
-		runServerNostr(*targetHost, *targetPort, relayURLs, *privateKey, *verbose)
+		runServerNostr(*targetHost, *targetPort, relayURLs, *privateKey, *keyPoolSize, *keyMaxUses, *replayWindow, clientAllowlist, sessionConfig, *verbose)
+	case "bench":
+		runBench(relayURLs, *keyPoolSize, *keyMaxUses, *replayWindow, sessionConfig, *benchSize, *benchPings, *verbose)
 	default:
-		log.Fatalf("Invalid mode '%s'. Must be 'client' or 'server'", *mode)
+		log.Fatalf("Invalid mode '%s'. Must be 'client', 'server' or 'bench'", *mode)
 	}
 }
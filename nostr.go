@@ -5,9 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -34,107 +34,45 @@ type KeyPair struct {
 type KeyManager struct {
 	keys *NostrKeys
 
-	// Pre-generated ephemeral key pool
-	ephemeralKeyPool []*KeyPair
-	keyPoolIndex     uint64 // Atomic counter for rotation
-	keyPoolSize      int
+	// One-time keys for gift wraps, generated ahead of use in the background
+	keyPool         chan *oneTimeKey
+	keyMaxUses      int
+	keyPoolStop     chan struct{}
+	keyPoolStopOnce sync.Once
+	keyMutex        sync.Mutex
+	currentKey      *oneTimeKey // Key signing gift wraps until it reaches keyMaxUses
+	keyPoolMisses   uint64      // Keys generated inline because the pool was empty
 
-	// Pre-computed conversation key cache
-	// targetPubkey -> []conversationKey (indexed by ephemeral key index)
-	conversationKeyCache map[string][][32]byte
-	cacheMutex           sync.RWMutex
+	// Conversation keys for decrypting received gift wraps, by one-time pubkey
+	receiveKeys *receiveKeyCache
 
-	// Track which targets have been initialized
-	initializedTargets map[string]bool
+	// IDs of recently received rumors, to reject replays
+	replays *replayCache
 }
 
-// NewKeyManager creates a new key manager
-func NewKeyManager(keysFile string) *KeyManager {
+// NewKeyManager creates a new key manager whose pool keeps poolSize one-time keys ready,
+// each signing at most maxUses gift wraps. Received rumors timestamped further than
+// replayWindow from our clock, or received before, are rejected
+func NewKeyManager(keysFile string, poolSize, maxUses int, replayWindow time.Duration) *KeyManager {
 	km := &KeyManager{
-		conversationKeyCache: make(map[string][][32]byte),
-		initializedTargets:   make(map[string]bool),
+		receiveKeys: newReceiveKeyCache(receiveKeyCacheSize),
+		replays:     newReplayCache(replayWindow),
 	}
 
-	// Initialize ephemeral key pool
-	km.initializeEphemeralKeyPool()
+	km.startKeyPool(poolSize, maxUses)
 
 	return km
 }
 
-// initializeEphemeralKeyPool pre-generates 5000 ephemeral keypairs for performance
-func (km *KeyManager) initializeEphemeralKeyPool() {
-	km.keyPoolSize = 5000
-	km.ephemeralKeyPool = make([]*KeyPair, km.keyPoolSize)
-
-	for i := 0; i < km.keyPoolSize; i++ {
-		privKey := nostr.GeneratePrivateKey()
-		pubKey, err := nostr.GetPublicKey(privKey)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to generate ephemeral key %d: %v", i, err))
-		}
-		km.ephemeralKeyPool[i] = &KeyPair{
-			PrivateKey: privKey,
-			PublicKey:  pubKey,
-		}
-	}
-
-	log.Printf("Initialized ephemeral key pool with %d keys", km.keyPoolSize)
+// ReceiveKeyCacheStats returns the hits, misses and size of the receive-side conversation key cache
+func (km *KeyManager) ReceiveKeyCacheStats() (uint64, uint64, int) {
+	return km.receiveKeys.stats()
 }
 
-// initializeTargetCache pre-computes conversation keys for a specific target
-func (km *KeyManager) initializeTargetCache(targetPubkey string) error {
-	km.cacheMutex.Lock()
-	defer km.cacheMutex.Unlock()
-
-	// Skip if already initialized
-	if km.initializedTargets[targetPubkey] {
-		return nil
-	}
-
-	// Initialize conversation key array for this target
-	conversationKeys := make([][32]byte, km.keyPoolSize)
-
-	// Pre-compute all conversation keys
-	for i := 0; i < km.keyPoolSize; i++ {
-		conversationKey, err := nip44.GenerateConversationKey(targetPubkey, km.ephemeralKeyPool[i].PrivateKey)
-		if err != nil {
-			return fmt.Errorf("failed to generate conversation key %d for target %s: %v", i, targetPubkey, err)
-		}
-		conversationKeys[i] = conversationKey
-	}
-
-	// Cache the conversation keys
-	km.conversationKeyCache[targetPubkey] = conversationKeys
-	km.initializedTargets[targetPubkey] = true
-
-	log.Printf("Pre-computed %d conversation keys for target %s", km.keyPoolSize, targetPubkey)
-	return nil
-}
-
-// getNextEphemeralKey returns the next ephemeral key with atomic rotation
-func (km *KeyManager) getNextEphemeralKey() (*KeyPair, int) {
-	index := atomic.AddUint64(&km.keyPoolIndex, 1) % uint64(km.keyPoolSize)
-	return km.ephemeralKeyPool[index], int(index)
-}
-
-// getConversationKey returns a pre-computed conversation key
-func (km *KeyManager) getConversationKey(targetPubkey string, ephemeralKeyIndex int) [32]byte {
-	km.cacheMutex.RLock()
-	defer km.cacheMutex.RUnlock()
-
-	return km.conversationKeyCache[targetPubkey][ephemeralKeyIndex]
-}
-
-// ensureTargetInitialized ensures conversation keys are pre-computed for a target
-func (km *KeyManager) ensureTargetInitialized(targetPubkey string) error {
-	km.cacheMutex.RLock()
-	initialized := km.initializedTargets[targetPubkey]
-	km.cacheMutex.RUnlock()
-
-	if !initialized {
-		return km.initializeTargetCache(targetPubkey)
-	}
-	return nil
+// ReplayStats returns how many received rumors were rejected as stale or replayed, and how
+// many rumor IDs are remembered
+func (km *KeyManager) ReplayStats() (uint64, int) {
+	return km.replays.stats()
 }
 
 // GenerateKeys generates new Nostr keys
@@ -155,6 +93,7 @@ func (km *KeyManager) GenerateKeys() error {
 		PrivateKey: privateKeyHex,
 		PublicKey:  publicKey,
 	}
+	km.receiveKeys.reset()
 
 	return nil
 }
@@ -390,6 +329,7 @@ func (km *KeyManager) LoadKeysFromPrivateKey(privateKeyStr string) error {
 		PrivateKey: privateKeyHex,
 		PublicKey:  publicKey,
 	}
+	km.receiveKeys.reset()
 
 	return nil
 }
@@ -455,6 +395,14 @@ type NostrRelayHandler struct {
 	ctx       context.Context
 	cancel    context.CancelFunc
 	eventChan chan *nostr.Event // Channel for received events
+
+	publishers map[string]*relayPublisher // Publishing connection of each relay, by URL
+
+	// Event counters, see EventStats
+	eventsPublished atomic.Uint64 // Events a relay accepted, counted once per relay
+	publishFailures atomic.Uint64 // Events that failed or were rejected, counted once per relay
+	eventsReceived  atomic.Uint64 // Events from the subscription, after deduplication across relays
+	eventsDropped   atomic.Uint64 // Received events dropped because the event channel was full
 }
 
 // NewNostrRelayHandler creates a new Nostr relay handler with multiple relays
@@ -494,6 +442,13 @@ func NewNostrRelayHandler(relayURLs []string, keyMgr *KeyManager, verbose bool)
 		eventChan: make(chan *nostr.Event, 100), // Buffered channel
 	}
 
+	// Events are published over connections of their own, which keep them in order and
+	// report the relay's answer to each
+	handler.publishers = make(map[string]*relayPublisher)
+	for _, relayURL := range relayURLs {
+		handler.publishers[relayURL] = newRelayPublisher(ctx, relayURL, handler.countPublish, verbose)
+	}
+
 	if verbose {
 		log.Printf("Created pool with %d relay(s): %v", pool.Relays.Size(), relayURLs)
 	}
@@ -540,37 +495,25 @@ func (nrh *NostrRelayHandler) PublishEvent(event *nostr.Event) error {
 	return nil
 }
 
-// PublishEventAsync publishes a Nostr event asynchronously without blocking
-func (nrh *NostrRelayHandler) PublishEventAsync(event *nostr.Event) {
-	go func() {
-		// Use the pool's PublishMany method which handles multiple relays automatically
-		results := nrh.pool.PublishMany(nrh.ctx, nrh.relayURLs, *event)
-
-		successCount := 0
-		var errors []string
-
-		for result := range results {
-			if result.Error != nil {
-				errors = append(errors, fmt.Sprintf("%s: %v", result.RelayURL, result.Error))
-				if nrh.verbose {
-					log.Printf("Failed to publish event %s to relay %s: %v", event.ID, result.RelayURL, result.Error)
-				}
-			} else {
-				successCount++
-				if nrh.verbose {
-					log.Printf("Published event %s to relay %s", event.ID, result.RelayURL)
-				}
-			}
-		}
+// publishTo sends an event to one relay and returns a channel that yields the relay's answer.
+// It returns once the event is written, so events reach each relay in the order they are sent
+func (nrh *NostrRelayHandler) publishTo(url string, event *nostr.Event) <-chan error {
+	publisher, exists := nrh.publishers[url]
+	if !exists {
+		answer := make(chan error, 1)
+		answer <- fmt.Errorf("unknown relay %s", url)
+		return answer
+	}
+	return publisher.send(event)
+}
 
-		if successCount == 0 {
-			if nrh.verbose {
-				log.Printf("Failed to publish event %s to any relay: %v", event.ID, errors)
-			}
-		} else if len(errors) > 0 && nrh.verbose {
-			log.Printf("Published event %s to %d/%d relays, errors: %v", event.ID, successCount, len(nrh.relayURLs), errors)
-		}
-	}()
+// countPublish counts the outcome of one event published to one relay
+func (nrh *NostrRelayHandler) countPublish(err error) {
+	if err == nil {
+		nrh.eventsPublished.Add(1)
+	} else {
+		nrh.publishFailures.Add(1)
+	}
 }
 
 // SubscribeToEvents subscribes to events for a specific pubkey using the pool
@@ -625,12 +568,14 @@ func (nrh *NostrRelayHandler) SubscribeToGiftWrapEvents(targetPubkey string) err
 		for relayEvent := range events {
 			select {
 			case nrh.eventChan <- relayEvent.Event:
+				nrh.eventsReceived.Add(1)
 				if nrh.verbose {
 					log.Printf("Received encrypted gift wrap event %s from relay %s", relayEvent.Event.ID, relayEvent.Relay)
 				}
 			case <-nrh.ctx.Done():
 				return
 			default:
+				nrh.eventsDropped.Add(1)
 				if nrh.verbose {
 					log.Printf("Event channel full, dropping gift wrap event %s from relay %s", relayEvent.Event.ID, relayEvent.Relay)
 				}
@@ -645,6 +590,12 @@ func (nrh *NostrRelayHandler) SubscribeToGiftWrapEvents(targetPubkey string) err
 	return nil
 }
 
+// EventStats returns how many event writes to relays succeeded and failed, and how many
+// events were received and dropped on arrival
+func (nrh *NostrRelayHandler) EventStats() (published, failed, received, dropped uint64) {
+	return nrh.eventsPublished.Load(), nrh.publishFailures.Load(), nrh.eventsReceived.Load(), nrh.eventsDropped.Load()
+}
+
 // GetEventChannel returns the channel for receiving events
 func (nrh *NostrRelayHandler) GetEventChannel() <-chan *nostr.Event {
 	return nrh.eventChan
@@ -675,8 +626,31 @@ type ParsedPacket struct {
 	TargetHost   string
 	TargetPort   int
 	ClientAddr   string
+	ErrorCode    string // Error code of a close packet (see ErrorCodeRefused and friends)
 	ErrorMsg     string
-	ClientPubkey string // Real client pubkey from the rumor
+	ClientPubkey string // Sender pubkey from the signed rumor
+
+	// Acknowledgement state piggybacked by the sender (see ackTags)
+	HasAck        bool     // Whether an ack tag was present
+	Ack           uint64   // Cumulative ack: every sequence below this was received
+	SelectiveAcks []uint64 // Sequences received out of order above the cumulative ack
+	HasWindow     bool     // Whether a window tag was present
+	Window        int      // Receive credit in bytes the sender grants us beyond its unacknowledged data
+
+	// Fragmentation of one chunk across consecutive data packets (see fragmentTag)
+	FragmentIndex int
+	FragmentCount int // Zero or one when the packet is not fragmented
+
+	Encoding Compression // Compression applied to the data of a data packet, empty if sent as is
+
+	// Handshake parameters carried by open and open_ack packets
+	Status            string        // "accept" or "reject" (open_ack only)
+	Format            RumorFormat   // Rumor format the sender is able to receive
+	Compression       Compression   // Payload compression the sender is able to receive
+	HeartbeatInterval time.Duration // The sender's heartbeat interval, zero if not announced
+	Nonce             string        // The sender's session nonce
+
+	PeerNonce string // Our session nonce echoed by the sender, empty before it learned it
 }
 
 // ParseNostrEvent parses a Nostr event to extract packet data and metadata from tags
@@ -754,19 +728,20 @@ func IsEventForMe(event *nostr.Event, myPubkey string) bool {
 // CreateEphemeralGiftWrappedEvent creates an ephemeral gift wrapped event for secure transmission
 // Uses ephemeral kinds (20000-29999) to ensure events are not stored permanently by relays
 // Now encrypts rumor directly with gift wrap, skipping the seal layer
-func (km *KeyManager) CreateEphemeralGiftWrappedEvent(packet *Packet, targetPubkey string, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string) (*nostr.Event, error) {
+// extraTags carries optional protocol metadata (acknowledgements etc.) into the rumor
+func (km *KeyManager) CreateEphemeralGiftWrappedEvent(packet *Packet, targetPubkey string, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string, format RumorFormat, padding PaddingBuckets, extraTags ...nostr.Tag) (*nostr.Event, error) {
 	if km.keys == nil {
 		return nil, fmt.Errorf("keys not loaded")
 	}
 
-	// 1. Create the rumor (unsigned event with kind 20547) - now includes sender pubkey
-	rumor, err := km.createEphemeralRumor(packet, packetType, sessionID, sequence, direction, targetHost, targetPort, clientAddr, errorMsg)
+	// 1. Create the rumor (event with kind 20547, signed by the sender)
+	rumor, err := km.createEphemeralRumor(packet, packetType, sessionID, sequence, direction, targetHost, targetPort, clientAddr, errorMsg, format, padding, extraTags...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create rumor: %v", err)
 	}
 
 	// 2. Create ephemeral gift wrap (kind 21059) with encrypted rumor directly
-	giftWrap, err := km.createEphemeralGiftWrap(rumor, targetPubkey)
+	giftWrap, err := km.createEphemeralGiftWrap(rumor, packet.Data, format, targetPubkey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gift wrap: %v", err)
 	}
@@ -774,8 +749,9 @@ func (km *KeyManager) CreateEphemeralGiftWrappedEvent(packet *Packet, targetPubk
 	return giftWrap, nil
 }
 
-// createEphemeralRumor creates an unsigned event (rumor) with kind 20547
-func (km *KeyManager) createEphemeralRumor(packet *Packet, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string) (*nostr.Event, error) {
+// createEphemeralRumor creates the rumor, a kind 20547 event signed with our identity key and
+// padded to one of the padding buckets when serialized in format
+func (km *KeyManager) createEphemeralRumor(packet *Packet, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string, format RumorFormat, padding PaddingBuckets, extraTags ...nostr.Tag) (*nostr.Event, error) {
 	// Encode packet data as base64 for content
 	var content string
 	if len(packet.Data) > 0 {
@@ -790,6 +766,7 @@ func (km *KeyManager) createEphemeralRumor(packet *Packet, packetType PacketType
 		{"session", sessionID},                    // Session identifier
 		{"sequence", fmt.Sprintf("%d", sequence)}, // Sequence number
 		{"direction", direction},                  // Direction (client_to_server, server_to_client)
+		{"salt", newRandomID()},                   // Makes the ID unique, e.g. of a retransmission built within the same second
 	}
 
 	// Add optional tags based on packet type
@@ -805,8 +782,9 @@ func (km *KeyManager) createEphemeralRumor(packet *Packet, packetType PacketType
 	if errorMsg != "" {
 		tags = append(tags, nostr.Tag{"error", errorMsg})
 	}
+	tags = append(tags, extraTags...)
 
-	// Create unsigned rumor event
+	// Create rumor event
 	rumor := &nostr.Event{
 		Kind:      20547,   // Ephemeral event for TCP proxy packets
 		Content:   content, // Base64 encoded raw data only
@@ -815,33 +793,45 @@ func (km *KeyManager) createEphemeralRumor(packet *Packet, packetType PacketType
 		PubKey:    km.keys.PublicKey,
 	}
 
-	// Calculate ID for the rumor (but don't sign it)
-	rumor.ID = rumor.GetID()
+	// Pad before signing so the signature covers the padding
+	if len(padding) > 0 {
+		if err := padRumor(rumor, packet.Data, format, padding); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sign the rumor so the recipient can verify who sent it; the gift wrap is signed by a
+	// one-time key and proves nothing about the sender
+	if err := rumor.Sign(km.keys.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign rumor: %v", err)
+	}
 
 	return rumor, nil
 }
 
 // createEphemeralGiftWrap creates an ephemeral gift wrap (kind 21059) with encrypted rumor
-func (km *KeyManager) createEphemeralGiftWrap(rumor *nostr.Event, targetPubkey string) (*nostr.Event, error) {
-	// Ensure target cache is initialized
-	if err := km.ensureTargetInitialized(targetPubkey); err != nil {
-		return nil, fmt.Errorf("failed to initialize target cache: %v", err)
+// serialized in the given format; data is the packet data carried by the rumor
+func (km *KeyManager) createEphemeralGiftWrap(rumor *nostr.Event, data []byte, format RumorFormat, targetPubkey string) (*nostr.Event, error) {
+	// Get a pre-generated one-time key
+	oneTimeKey, err := km.nextOneTimeKey()
+	if err != nil {
+		return nil, err
 	}
 
-	// Get pre-generated one-time key and its index
-	oneTimeKey, ephemeralKeyIndex := km.getNextEphemeralKey()
-
-	// Serialize rumor to JSON
-	rumorJSON, err := json.Marshal(rumor)
+	// Serialize rumor in the format the recipient accepts
+	rumorBytes, err := encodeRumor(rumor, data, format)
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize rumor: %v", err)
 	}
 
-	// Get pre-computed conversation key (zero computation!)
-	conversationKey := km.getConversationKey(targetPubkey, ephemeralKeyIndex)
+	// Derive the conversation key, or reuse it if this key already wrapped for the target
+	conversationKey, err := oneTimeKey.conversationKey(targetPubkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate conversation key: %v", err)
+	}
 
 	// Encrypt rumor using NIP-44 with pre-computed conversation key
-	encryptedRumor, err := nip44.Encrypt(string(rumorJSON), conversationKey)
+	encryptedRumor, err := nip44.Encrypt(string(rumorBytes), conversationKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt rumor: %v", err)
 	}
@@ -867,30 +857,68 @@ func (km *KeyManager) createEphemeralGiftWrap(rumor *nostr.Event, targetPubkey s
 
 // UnwrapEphemeralGiftWrap unwraps an ephemeral gift wrapped event
 func (km *KeyManager) UnwrapEphemeralGiftWrap(giftWrap *nostr.Event) (*ParsedPacket, error) {
-	// Generate conversation key for decryption (recipient's private key + one-time public key)
-	conversationKey, err := nip44.GenerateConversationKey(giftWrap.PubKey, km.keys.PrivateKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate conversation key: %v", err)
+	// Conversation key for decryption (recipient's private key + one-time public key);
+	// cached while senders keep signing with the same one-time key
+	conversationKey, cached := km.receiveKeys.get(giftWrap.PubKey)
+	if !cached {
+		var err error
+		conversationKey, err = nip44.GenerateConversationKey(giftWrap.PubKey, km.keys.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate conversation key: %v", err)
+		}
+		km.receiveKeys.put(giftWrap.PubKey, conversationKey)
 	}
 
 	// Decrypt the rumor from the gift wrap
-	rumorJSON, err := nip44.Decrypt(giftWrap.Content, conversationKey)
+	rumorBytes, err := nip44.Decrypt(giftWrap.Content, conversationKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt rumor: %v", err)
 	}
 
-	// Parse the rumor
-	var rumor nostr.Event
-	if err := json.Unmarshal([]byte(rumorJSON), &rumor); err != nil {
-		return nil, fmt.Errorf("failed to parse rumor: %v", err)
+	// Parse the rumor, which may be JSON or binary
+	rumor, data, err := decodeRumor([]byte(rumorBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only a valid signature makes the rumor's pubkey the sender's identity
+	if err := verifyRumor(rumor, data); err != nil {
+		return nil, err
+	}
+
+	// The signed ID and timestamp identify a recorded rumor published again
+	if err := km.replays.check(rumor.ID, rumor.CreatedAt.Time()); err != nil {
+		return nil, err
 	}
 
 	// Parse the rumor as a ParsedPacket
-	return km.parseRumorAsPacket(&rumor)
+	return km.parseRumorAsPacket(rumor, data)
+}
+
+// verifyRumor checks that the rumor is signed by its pubkey. The ID and signature cover the
+// base64 content, which binary rumors leave out, so the content is rebuilt from the packet data
+func verifyRumor(rumor *nostr.Event, data []byte) error {
+	signed := *rumor
+	signed.Content = ""
+	if len(data) > 0 {
+		signed.Content = base64.StdEncoding.EncodeToString(data)
+	}
+
+	if !signed.CheckID() {
+		return fmt.Errorf("rumor id does not match its content")
+	}
+	valid, err := signed.CheckSignature()
+	if err != nil {
+		return fmt.Errorf("invalid rumor signature: %v", err)
+	}
+	if !valid {
+		return fmt.Errorf("rumor signature does not match pubkey %s", rumor.PubKey)
+	}
+	return nil
 }
 
-// parseRumorAsPacket parses a rumor event into a ParsedPacket
-func (km *KeyManager) parseRumorAsPacket(rumor *nostr.Event) (*ParsedPacket, error) {
+// parseRumorAsPacket parses a rumor event and its already decoded packet data into a ParsedPacket
+func (km *KeyManager) parseRumorAsPacket(rumor *nostr.Event, data []byte) (*ParsedPacket, error) {
 	// Verify event kind
 	if rumor.Kind != 20547 {
 		return nil, fmt.Errorf("invalid rumor kind: %d", rumor.Kind)
@@ -902,23 +930,13 @@ func (km *KeyManager) parseRumorAsPacket(rumor *nostr.Event) (*ParsedPacket, err
 		return nil, fmt.Errorf("incompatible version %s in rumor", version)
 	}
 
-	// Decode base64 content to get raw data
-	var data []byte
-	if rumor.Content != "" {
-		decoded, err := base64.StdEncoding.DecodeString(rumor.Content)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode base64 content: %v", err)
-		}
-		data = decoded
-	}
-
 	// Create packet with raw data
 	packet := &Packet{Data: data}
 
 	// Extract metadata from tags
 	parsed := &ParsedPacket{
 		Packet:       packet,
-		ClientPubkey: rumor.PubKey, // Extract real client pubkey from rumor
+		ClientPubkey: rumor.PubKey, // Sender's identity, verified by the rumor's signature
 	}
 
 	// Helper function to get tag value
@@ -948,6 +966,15 @@ func (km *KeyManager) parseRumorAsPacket(rumor *nostr.Event) (*ParsedPacket, err
 	parsed.ClientAddr = getTagValue("client_addr")
 	parsed.ErrorMsg = getTagValue("error")
 
+	// Structured errors are ["error", code, detail]; a single value is a plain message
+	for _, tag := range rumor.Tags {
+		if len(tag) >= 3 && tag[0] == "error" {
+			parsed.ErrorCode = tag[1]
+			parsed.ErrorMsg = tag[2]
+			break
+		}
+	}
+
 	// Parse target port
 	if portStr := getTagValue("target_port"); portStr != "" {
 		if _, err := fmt.Sscanf(portStr, "%d", &parsed.TargetPort); err != nil {
@@ -955,39 +982,76 @@ func (km *KeyManager) parseRumorAsPacket(rumor *nostr.Event) (*ParsedPacket, err
 		}
 	}
 
-	return parsed, nil
-}
-
-// SendNostrPacket sends a packet as an encrypted Nostr event asynchronously
-func SendNostrPacket(relayHandler *NostrRelayHandler, keyMgr *KeyManager, packet *Packet, targetPubkey string, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string, verbose bool) error {
-	// Create encrypted gift wrapped event for the packet
-	event, err := keyMgr.CreateEphemeralGiftWrappedEvent(packet, targetPubkey, packetType, sessionID, sequence, direction, targetHost, targetPort, clientAddr, errorMsg)
-	if err != nil {
-		return fmt.Errorf("failed to create encrypted Nostr event: %v", err)
+	// Parse acknowledgement state
+	if ackStr := getTagValue("ack"); ackStr != "" {
+		ack, err := strconv.ParseUint(ackStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ack: %s", ackStr)
+		}
+		parsed.HasAck = true
+		parsed.Ack = ack
+	}
+	if sackStr := getTagValue("sack"); sackStr != "" {
+		for _, seqStr := range strings.Split(sackStr, ",") {
+			seq, err := strconv.ParseUint(seqStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selective ack: %s", sackStr)
+			}
+			parsed.SelectiveAcks = append(parsed.SelectiveAcks, seq)
+		}
+	}
+	if windowStr := getTagValue("window"); windowStr != "" {
+		window, err := strconv.Atoi(windowStr)
+		if err != nil || window < 0 {
+			return nil, fmt.Errorf("invalid window: %s", windowStr)
+		}
+		parsed.HasWindow = true
+		parsed.Window = window
 	}
 
-	// Publish event to relay asynchronously for better performance
-	relayHandler.PublishEventAsync(event)
+	// Parse fragment position
+	for _, tag := range rumor.Tags {
+		if len(tag) >= 3 && tag[0] == "frag" {
+			index, indexErr := strconv.Atoi(tag[1])
+			count, countErr := strconv.Atoi(tag[2])
+			if indexErr != nil || countErr != nil || count < 1 || index < 0 || index >= count {
+				return nil, fmt.Errorf("invalid fragment tag: %v", tag)
+			}
+			parsed.FragmentIndex = index
+			parsed.FragmentCount = count
+			break
+		}
+	}
 
-	if verbose {
-		log.Printf("Nostr: Sent encrypted packet (type=%s, session=%s, seq=%d) as gift wrap event %s", packetType, sessionID, sequence, event.ID)
+	// Parse handshake parameters
+	parsed.Status = getTagValue("status")
+	parsed.Format = RumorFormat(getTagValue("format"))
+	parsed.Compression = Compression(getTagValue("compression"))
+	parsed.Encoding = Compression(getTagValue("encoding"))
+	parsed.Nonce = getTagValue("nonce")
+	parsed.PeerNonce = getTagValue("peer_nonce")
+	if intervalStr := getTagValue("heartbeat_interval"); intervalStr != "" {
+		intervalMs, err := strconv.ParseInt(intervalStr, 10, 64)
+		if err != nil || intervalMs < 0 {
+			return nil, fmt.Errorf("invalid heartbeat interval: %s", intervalStr)
+		}
+		parsed.HeartbeatInterval = time.Duration(intervalMs) * time.Millisecond
 	}
 
-	return nil
+	return parsed, nil
 }
 
-// SendNostrPacketSync sends a packet as an encrypted Nostr event synchronously
-func SendNostrPacketSync(relayHandler *NostrRelayHandler, keyMgr *KeyManager, packet *Packet, targetPubkey string, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string, verbose bool) error {
+// SendNostrPacket sends a packet as an encrypted Nostr event through a session's publish queue.
+// It returns once the event is queued; published is called with the outcome (see PublishQueue.Publish)
+func SendNostrPacket(publishQueue *PublishQueue, keyMgr *KeyManager, packet *Packet, targetPubkey string, packetType PacketType, sessionID string, sequence uint64, direction string, targetHost string, targetPort int, clientAddr string, errorMsg string, format RumorFormat, padding PaddingBuckets, verbose bool, published func(error), extraTags ...nostr.Tag) error {
 	// Create encrypted gift wrapped event for the packet
-	event, err := keyMgr.CreateEphemeralGiftWrappedEvent(packet, targetPubkey, packetType, sessionID, sequence, direction, targetHost, targetPort, clientAddr, errorMsg)
+	event, err := keyMgr.CreateEphemeralGiftWrappedEvent(packet, targetPubkey, packetType, sessionID, sequence, direction, targetHost, targetPort, clientAddr, errorMsg, format, padding, extraTags...)
 	if err != nil {
 		return fmt.Errorf("failed to create encrypted Nostr event: %v", err)
 	}
 
-	// Publish event to relay synchronously to ensure order
-	if err := relayHandler.PublishEvent(event); err != nil {
-		return fmt.Errorf("failed to publish Nostr event: %v", err)
-	}
+	// Queue the event; every relay receives a session's events in the order they were queued
+	publishQueue.Publish(event, published)
 
 	if verbose {
 		log.Printf("Nostr: Sent encrypted packet (type=%s, session=%s, seq=%d) as gift wrap event %s", packetType, sessionID, sequence, event.ID)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestUnwrapRejectsTamperedRumors(t *testing.T) {
+	sender := newTestKeyManager(t)
+	recipient := newTestKeyManager(t)
+	other := newTestKeyManager(t)
+	payload := []byte("payload signed by the sender")
+
+	tests := []struct {
+		name    string
+		format  RumorFormat
+		tamper  func(rumor *nostr.Event, data []byte) []byte // Changes the signed rumor and returns the data to send
+		wantErr bool
+	}{
+		{name: "json untouched", format: RumorFormatJSON, tamper: func(rumor *nostr.Event, data []byte) []byte { return data }},
+		{name: "binary untouched", format: RumorFormatBinary, tamper: func(rumor *nostr.Event, data []byte) []byte { return data }},
+		{
+			name:   "json pubkey swapped",
+			format: RumorFormatJSON,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				rumor.PubKey = other.GetKeys().PublicKey
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name:   "binary pubkey swapped",
+			format: RumorFormatBinary,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				rumor.PubKey = other.GetKeys().PublicKey
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name:   "binary payload changed",
+			format: RumorFormatBinary,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				changed := bytes.Clone(data)
+				changed[len(changed)-1] ^= 0xff
+				return changed
+			},
+			wantErr: true,
+		},
+		{
+			name:   "json content changed",
+			format: RumorFormatJSON,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				changed := []byte("payload forged by someone else")
+				rumor.Content = base64.StdEncoding.EncodeToString(changed)
+				return changed
+			},
+			wantErr: true,
+		},
+		{
+			name:   "empty sig",
+			format: RumorFormatJSON,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				rumor.Sig = ""
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name:   "garbage sig",
+			format: RumorFormatBinary,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				rumor.Sig = strings.Repeat("ab", 64)
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name:   "sig not hex",
+			format: RumorFormatJSON,
+			tamper: func(rumor *nostr.Event, data []byte) []byte {
+				rumor.Sig = "not a signature"
+				return data
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rumor, err := sender.createEphemeralRumor(NewPacket(payload), PacketTypeData, "session", 0, "client_to_server", "", 0, "", "", tt.format, nil)
+			if err != nil {
+				t.Fatalf("createEphemeralRumor: %v", err)
+			}
+			data := tt.tamper(rumor, payload)
+			giftWrap, err := sender.createEphemeralGiftWrap(rumor, data, tt.format, recipient.GetKeys().PublicKey)
+			if err != nil {
+				t.Fatalf("createEphemeralGiftWrap: %v", err)
+			}
+
+			parsed, err := recipient.UnwrapEphemeralGiftWrap(giftWrap)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnwrapEphemeralGiftWrap error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (parsed.ClientPubkey != sender.GetKeys().PublicKey || !bytes.Equal(parsed.Packet.Data, payload)) {
+				t.Errorf("unwrapped packet from %s with data %q", parsed.ClientPubkey, parsed.Packet.Data)
+			}
+		})
+	}
+}
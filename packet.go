@@ -9,10 +9,13 @@ type PacketType string
 
 const (
 	PacketTypeOpen      PacketType = "open"      // Session open/handshake
+	PacketTypeOpenAck   PacketType = "open_ack"  // Server's answer to open: accept or reject
 	PacketTypeData      PacketType = "data"      // Data transfer
+	PacketTypeFin       PacketType = "fin"       // Half-close: the sender has no more data
 	PacketTypeClose     PacketType = "close"     // Session close
 	PacketTypeAck       PacketType = "ack"       // Acknowledgment
 	PacketTypeHeartbeat PacketType = "heartbeat" // Keep-alive
+	PacketTypeCover     PacketType = "cover"     // Dummy traffic, discarded by the receiver
 )
 
 // Packet represents raw TCP data for Nostr events
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Placeholders with the length of a real id and signature, for measuring a rumor before it is signed
+var (
+	placeholderID  = strings.Repeat("0", 64)
+	placeholderSig = strings.Repeat("0", 128)
+)
+
+// PaddingBuckets lists serialized rumor sizes in ascending order. Every rumor is padded up to
+// the smallest bucket it fits in, so gift wraps only come in a few sizes and don't reveal how
+// much data they carry. Empty disables padding
+type PaddingBuckets []int
+
+// ParsePaddingBuckets parses a comma-separated list of bucket sizes in bytes from the command line
+func ParsePaddingBuckets(value string) (PaddingBuckets, error) {
+	if value == "" || value == "none" {
+		return nil, nil
+	}
+
+	var buckets PaddingBuckets
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid padding bucket %q (use sizes in bytes, e.g. 1024,8192,32768)", field)
+		}
+		buckets = append(buckets, size)
+	}
+	sort.Ints(buckets)
+	return buckets, nil
+}
+
+// String returns the buckets as accepted by ParsePaddingBuckets
+func (pb PaddingBuckets) String() string {
+	if len(pb) == 0 {
+		return "none"
+	}
+	sizes := make([]string, len(pb))
+	for i, size := range pb {
+		sizes[i] = strconv.Itoa(size)
+	}
+	return strings.Join(sizes, ",")
+}
+
+// limit drops buckets too large for one event and adds the largest rumor an event can carry
+// as the last bucket, so no rumor is left unpadded. It returns nil if padding is disabled
+func (pb PaddingBuckets) limit(maxRumorSize int) PaddingBuckets {
+	if len(pb) == 0 {
+		return nil
+	}
+
+	limited := make(PaddingBuckets, 0, len(pb)+1)
+	for _, size := range pb {
+		if size < maxRumorSize {
+			limited = append(limited, size)
+		}
+	}
+	return append(limited, maxRumorSize)
+}
+
+// target returns the size a rumor of size bytes is padded to
+func (pb PaddingBuckets) target(size int) int {
+	for _, bucket := range pb {
+		if bucket >= size {
+			return bucket
+		}
+	}
+	return size
+}
+
+// padRumor adds a padding tag to an unsigned rumor so that, once signed and serialized in
+// format, it is exactly as large as its bucket. The tag is covered by the signature and
+// ignored by the recipient
+func padRumor(rumor *nostr.Event, data []byte, format RumorFormat, buckets PaddingBuckets) error {
+	rumor.Tags = append(rumor.Tags, nostr.Tag{"padding", ""})
+	rumor.ID = placeholderID
+	rumor.Sig = placeholderSig
+
+	encoded, err := encodeRumor(rumor, data, format)
+	if err != nil {
+		return fmt.Errorf("failed to measure rumor: %v", err)
+	}
+	fill := buckets.target(len(encoded)) - len(encoded)
+	if format == RumorFormatBinary {
+		// The padding goes into the header, whose length is a 16-bit field
+		headerLen := len(encoded) - binaryRumorHeaderSize - len(data)
+		fill = min(fill, 0xffff-headerLen)
+	}
+	if fill > 0 {
+		rumor.Tags[len(rumor.Tags)-1][1] = strings.Repeat("0", fill)
+	}
+	return nil
+}
+
+// newCoverPacket returns a dummy packet with up to maxData bytes of data. The data is
+// encrypted like any other, so zeros are as good as random bytes
+func newCoverPacket(maxData int) *Packet {
+	return NewPacket(make([]byte, rand.IntN(maxData+1)))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePaddingBuckets(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    PaddingBuckets
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"none", nil, false},
+		{"1024", PaddingBuckets{1024}, false},
+		{"8192, 1024,32768", PaddingBuckets{1024, 8192, 32768}, false},
+		{"1024,x", nil, true},
+		{"0", nil, true},
+		{"-5", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePaddingBuckets(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePaddingBuckets(%q) error %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePaddingBuckets(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPaddingBucketsLimitAndTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets PaddingBuckets
+		max     int
+		want    PaddingBuckets
+		targets map[int]int // Rumor size to padded size
+	}{
+		{"disabled", nil, 5000, nil, map[int]int{100: 100}},
+		{"all fit", PaddingBuckets{1000, 2000}, 5000, PaddingBuckets{1000, 2000, 5000}, map[int]int{1: 1000, 1000: 1000, 1001: 2000, 4000: 5000, 5000: 5000}},
+		{"too large dropped", PaddingBuckets{1000, 5000, 9000}, 5000, PaddingBuckets{1000, 5000}, map[int]int{1500: 5000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited := tt.buckets.limit(tt.max)
+			if !reflect.DeepEqual(limited, tt.want) {
+				t.Fatalf("limit(%d) = %v, want %v", tt.max, limited, tt.want)
+			}
+			for size, want := range tt.targets {
+				if got := limited.target(size); got != want {
+					t.Errorf("target(%d) = %d, want %d", size, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPadRumorExactSize(t *testing.T) {
+	km := newTestKeyManager(t)
+	buckets := PaddingBuckets{1024, 4096, 16384}
+
+	for _, format := range []RumorFormat{RumorFormatJSON, RumorFormatBinary} {
+		for _, size := range []int{0, 100, 1500, 8000} {
+			data := make([]byte, size)
+			rumor, err := km.createEphemeralRumor(NewPacket(data), PacketTypeData, "session", 1, "client_to_server", "", 0, "", "", format, buckets)
+			if err != nil {
+				t.Fatalf("%s/%d: %v", format, size, err)
+			}
+			encoded, err := encodeRumor(rumor, data, format)
+			if err != nil {
+				t.Fatalf("%s/%d: %v", format, size, err)
+			}
+			if want := buckets.target(len(encoded)); len(encoded) != want {
+				t.Errorf("%s/%d: rumor is %d bytes, want %d", format, size, len(encoded), want)
+			}
+			if !rumor.CheckID() {
+				t.Errorf("%s/%d: rumor ID does not cover the padding", format, size)
+			}
+		}
+	}
+}
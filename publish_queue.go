@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	publishQueueSize     = 256              // Events that may wait for one relay before new ones are dropped
+	maxPublishesPerRelay = 64               // Events one pipeline has sent and is waiting on the relay's OK for
+	publishTimeout       = 10 * time.Second // How long a relay may take to answer an event
+)
+
+// PublishQueue publishes one session's events through the shared relay pool. Every relay
+// gets its own pipeline that sends events in submission order without waiting for the
+// relay's OK before sending the next, so consecutive packets reach each relay in order
+// while several are in flight. An event counts as published on a relay once the relay
+// accepted it with an OK. The outcome of each event is reported to its callback once all
+// relays have answered or failed
+type PublishQueue struct {
+	owner   string // Log prefix, e.g. "Client: Session <id>"
+	verbose bool
+
+	pipelines []*relayPipeline
+	mutex     sync.Mutex // Makes submission to all pipelines atomic so they see the same order
+	closed    bool
+}
+
+// relayPipeline sends queued events to one relay, one after the other
+type relayPipeline struct {
+	queue   *PublishQueue
+	url     string
+	publish publishFunc
+	jobs    chan *publishJob
+}
+
+// publishFunc sends one event to the relay at url and returns once it is written, with a
+// channel that yields the relay's answer
+type publishFunc func(url string, event *nostr.Event) <-chan error
+
+// publishJob is one event being published to every relay
+type publishJob struct {
+	event *nostr.Event
+	done  func(error) // Called once with nil if at least one relay accepted the event; may be nil
+
+	mutex     sync.Mutex
+	remaining int
+	published int
+	errors    []string
+}
+
+// NewPublishQueue creates a queue on top of relayHandler and starts a pipeline per relay
+func NewPublishQueue(relayHandler *NostrRelayHandler, owner string, verbose bool) *PublishQueue {
+	return newPublishQueue(relayHandler.GetRelayURLs(), relayHandler.publishTo, owner, verbose)
+}
+
+// newPublishQueue creates a queue that publishes to each of urls through publish
+func newPublishQueue(urls []string, publish publishFunc, owner string, verbose bool) *PublishQueue {
+	pq := &PublishQueue{
+		owner:   owner,
+		verbose: verbose,
+	}
+	for _, url := range urls {
+		pipeline := &relayPipeline{
+			queue:   pq,
+			url:     url,
+			publish: publish,
+			jobs:    make(chan *publishJob, publishQueueSize),
+		}
+		pq.pipelines = append(pq.pipelines, pipeline)
+		go pipeline.run()
+	}
+	return pq
+}
+
+// Publish queues an event on every relay's pipeline without blocking and calls done with the
+// outcome. A relay whose pipeline is full skips the event; sequenced packets are retransmitted
+// and acks are sent again, so nothing is lost for good
+func (pq *PublishQueue) Publish(event *nostr.Event, done func(error)) {
+	job := &publishJob{
+		event:     event,
+		done:      done,
+		remaining: len(pq.pipelines),
+	}
+
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pq.closed {
+		job.remaining = 0
+		job.finish()
+		return
+	}
+	for _, pipeline := range pq.pipelines {
+		select {
+		case pipeline.jobs <- job:
+		default:
+			if pq.verbose {
+				log.Printf("%s - Publish queue for %s full, dropping event %s", pq.owner, pipeline.url, event.ID)
+			}
+			job.report(pq, pipeline.url, fmt.Errorf("publish queue full"))
+		}
+	}
+}
+
+// Close stops accepting events; events already queued, such as the last acks of a
+// closing session, are still published
+func (pq *PublishQueue) Close() {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pq.closed {
+		return
+	}
+	pq.closed = true
+	for _, pipeline := range pq.pipelines {
+		close(pipeline.jobs)
+	}
+}
+
+// run sends events to the relay in queue order until the pipeline is closed and drained.
+// Each event is written before the next one, but their answers are awaited concurrently,
+// so the next event goes out without waiting for the relay's OK on the previous one
+func (rp *relayPipeline) run() {
+	inflight := make(chan struct{}, maxPublishesPerRelay)
+	for job := range rp.jobs {
+		inflight <- struct{}{}
+		answer := rp.publish(rp.url, job.event)
+		go func(job *publishJob) {
+			job.report(rp.queue, rp.url, <-answer)
+			<-inflight
+		}(job)
+	}
+}
+
+// report records one relay's result and calls done after the last one
+func (job *publishJob) report(pq *PublishQueue, url string, err error) {
+	job.mutex.Lock()
+	if err != nil {
+		job.errors = append(job.errors, fmt.Sprintf("%s: %v", url, err))
+		if pq.verbose {
+			log.Printf("%s - Failed to publish event %s to relay %s: %v", pq.owner, job.event.ID, url, err)
+		}
+	} else {
+		job.published++
+		if pq.verbose {
+			log.Printf("%s - Published event %s to relay %s", pq.owner, job.event.ID, url)
+		}
+	}
+	job.remaining--
+	last := job.remaining == 0
+	job.mutex.Unlock()
+
+	if last {
+		job.finish()
+	}
+}
+
+// finish reports the outcome of a job to its callback
+func (job *publishJob) finish() {
+	if job.done == nil {
+		return
+	}
+	if job.published > 0 {
+		job.done(nil)
+		return
+	}
+	if len(job.errors) == 0 {
+		job.done(ErrSessionClosed)
+		return
+	}
+	job.done(fmt.Errorf("failed to publish event to any relay: %s", strings.Join(job.errors, "; ")))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// answered returns a channel that already holds a relay's answer
+func answered(err error) <-chan error {
+	answer := make(chan error, 1)
+	answer <- err
+	return answer
+}
+
+func TestPublishQueueReportsRelayAnswers(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers map[string]error // Each relay's answer
+		wantErr bool
+	}{
+		{"accepted", map[string]error{"a": nil}, false},
+		{"rejected", map[string]error{"a": fmt.Errorf("rejected: invalid: message too large")}, true},
+		{"accepted by one", map[string]error{"a": fmt.Errorf("rejected: blocked"), "b": nil}, false},
+		{"rejected by all", map[string]error{"a": fmt.Errorf("rejected: blocked"), "b": fmt.Errorf("timeout")}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var urls []string
+			for url := range tt.answers {
+				urls = append(urls, url)
+			}
+			publish := func(url string, event *nostr.Event) <-chan error { return answered(tt.answers[url]) }
+			queue := newPublishQueue(urls, publish, "Test", false)
+			defer queue.Close()
+
+			done := make(chan error, 1)
+			queue.Publish(&nostr.Event{ID: "id"}, func(err error) { done <- err })
+			select {
+			case err := <-done:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("done(%v), want error %v", err, tt.wantErr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("done was not called")
+			}
+		})
+	}
+}
+
+func TestPublishQueueDoesNotWaitForAnswers(t *testing.T) {
+	answer := make(chan error)
+	sent := make(chan string, 3)
+	publish := func(url string, event *nostr.Event) <-chan error {
+		sent <- event.ID
+		return answer
+	}
+	queue := newPublishQueue([]string{"a"}, publish, "Test", false)
+	defer queue.Close()
+	defer close(answer)
+
+	// Every event is sent while the relay has answered none of them
+	for _, id := range []string{"1", "2", "3"} {
+		queue.Publish(&nostr.Event{ID: id}, nil)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d events sent before the first answer", i)
+		}
+	}
+}
+
+func TestPublishQueueKeepsOrderPerRelay(t *testing.T) {
+	const events = 200
+	var mutex sync.Mutex
+	arrived := make(map[string][]string)
+	publish := func(url string, event *nostr.Event) <-chan error {
+		mutex.Lock()
+		arrived[url] = append(arrived[url], event.ID)
+		mutex.Unlock()
+
+		// Answers come back in any order and after a while
+		answer := make(chan error, 1)
+		time.AfterFunc(time.Duration(len(event.ID)%3)*time.Millisecond, func() { answer <- nil })
+		return answer
+	}
+	queue := newPublishQueue([]string{"a", "b"}, publish, "Test", false)
+	defer queue.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(events)
+	for i := 0; i < events; i++ {
+		queue.Publish(&nostr.Event{ID: strconv.Itoa(i)}, func(error) { wg.Done() })
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, url := range []string{"a", "b"} {
+		if len(arrived[url]) != events {
+			t.Fatalf("relay %s got %d events, want %d", url, len(arrived[url]), events)
+		}
+		for i, id := range arrived[url] {
+			if id != strconv.Itoa(i) {
+				t.Fatalf("relay %s got event %s at position %d", url, id, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// receiveKeyCacheSize bounds the receive-side conversation key cache. A peer signs consecutive
+// gift wraps with one one-time key until it retires it, so only the latest key of each active
+// peer is worth keeping
+const receiveKeyCacheSize = 1024
+
+// receiveKeyCache is an LRU of conversation keys for decrypting gift wraps, keyed by the
+// wrap's one-time pubkey, so a recurring key costs a map lookup instead of an ECDH.
+// Peers that never reuse a key only cause misses, which cost no more than the ECDH itself
+type receiveKeyCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // Front is the most recently used
+	hits     uint64
+	misses   uint64
+}
+
+type receiveKeyEntry struct {
+	pubkey string
+	key    [32]byte
+}
+
+func newReceiveKeyCache(capacity int) *receiveKeyCache {
+	return &receiveKeyCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached conversation key for a wrap pubkey and counts the hit or miss
+func (rc *receiveKeyCache) get(pubkey string) ([32]byte, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	element, exists := rc.entries[pubkey]
+	if !exists {
+		rc.misses++
+		return [32]byte{}, false
+	}
+	rc.hits++
+	rc.order.MoveToFront(element)
+	return element.Value.(*receiveKeyEntry).key, true
+}
+
+// put stores a conversation key, evicting the least recently used one when full
+func (rc *receiveKeyCache) put(pubkey string, key [32]byte) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if element, exists := rc.entries[pubkey]; exists {
+		element.Value.(*receiveKeyEntry).key = key
+		rc.order.MoveToFront(element)
+		return
+	}
+
+	rc.entries[pubkey] = rc.order.PushFront(&receiveKeyEntry{pubkey: pubkey, key: key})
+	if rc.order.Len() > rc.capacity {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*receiveKeyEntry).pubkey)
+	}
+}
+
+// reset drops every entry, e.g. when our own private key changes
+func (rc *receiveKeyCache) reset() {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.entries = make(map[string]*list.Element)
+	rc.order.Init()
+}
+
+// stats returns the hit and miss counters and the number of cached keys
+func (rc *receiveKeyCache) stats() (uint64, uint64, int) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.hits, rc.misses, rc.order.Len()
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestReceiveKeyCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		puts     []string
+		hits     []string
+		misses   []string
+	}{
+		{"within capacity", 2, []string{"a", "b"}, []string{"a", "b"}, []string{"c"}},
+		{"evicts least recently used", 2, []string{"a", "b", "c"}, []string{"b", "c"}, []string{"a"}},
+		{"put refreshes", 2, []string{"a", "b", "a", "c"}, []string{"a", "c"}, []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newReceiveKeyCache(tt.capacity)
+			for _, pubkey := range tt.puts {
+				cache.put(pubkey, [32]byte{pubkey[0]})
+			}
+			for _, pubkey := range tt.hits {
+				if key, ok := cache.get(pubkey); !ok || key[0] != pubkey[0] {
+					t.Errorf("get(%q) = %v, %v, want its key", pubkey, key[0], ok)
+				}
+			}
+			for _, pubkey := range tt.misses {
+				if _, ok := cache.get(pubkey); ok {
+					t.Errorf("get(%q) hit, want a miss", pubkey)
+				}
+			}
+			hits, misses, size := cache.stats()
+			if hits != uint64(len(tt.hits)) || misses != uint64(len(tt.misses)) || size > tt.capacity {
+				t.Errorf("stats() = %d hits, %d misses, %d keys", hits, misses, size)
+			}
+		})
+	}
+}
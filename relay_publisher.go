@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	relayDialTimeout      = 10 * time.Second // How long connecting to a relay may take
+	relayReconnectBackoff = time.Second      // Events fail right away this long after a failed connect
+)
+
+// relayPublisher publishes events to one relay over a connection of its own, shared by all
+// sessions. Events are written one after the other in the order send is called, without
+// waiting for the relay's answer, and each OK is matched to its event by ID
+type relayPublisher struct {
+	url      string
+	ctx      context.Context // Closes the connection when cancelled
+	answered func(error)     // Called with the outcome of every event, e.g. to count it
+	verbose  bool
+
+	mutex       sync.Mutex // Serializes writes and guards the fields below
+	current     *publishConn
+	lastDialErr error
+	retryAfter  time.Time // No new connection is attempted before this
+}
+
+// publishConn is one connection to the relay and the events sent over it that await an OK
+type publishConn struct {
+	conn    *nostr.Connection
+	pending map[string]chan error // Event ID to the channel its answer is sent on
+}
+
+func newRelayPublisher(ctx context.Context, url string, answered func(error), verbose bool) *relayPublisher {
+	return &relayPublisher{url: url, ctx: ctx, answered: answered, verbose: verbose}
+}
+
+// send writes an event to the relay and returns a channel that yields nil once the relay
+// accepted it, or why it was not published: a write error, the relay's rejection, the
+// connection dropping or no answer within publishTimeout
+func (rp *relayPublisher) send(event *nostr.Event) <-chan error {
+	answer := make(chan error, 1)
+	envelope, err := (&nostr.EventEnvelope{Event: *event}).MarshalJSON()
+	if err != nil {
+		rp.finish(answer, fmt.Errorf("failed to encode event: %v", err))
+		return answer
+	}
+
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	pc, err := rp.connectLocked()
+	if err != nil {
+		rp.finish(answer, err)
+		return answer
+	}
+
+	// Registered before writing, since the OK may arrive before the write returns
+	pc.pending[event.ID] = answer
+	ctx, cancel := context.WithTimeout(rp.ctx, publishTimeout)
+	err = pc.conn.WriteMessage(ctx, envelope)
+	cancel()
+	if err != nil {
+		// The reader notices the broken connection and fails the other pending events
+		delete(pc.pending, event.ID)
+		rp.finish(answer, err)
+		return answer
+	}
+
+	time.AfterFunc(publishTimeout, func() {
+		rp.answer(pc, event.ID, fmt.Errorf("no answer from relay within %v", publishTimeout))
+	})
+	return answer
+}
+
+// connectLocked returns the current connection, dialing a new one if there is none
+func (rp *relayPublisher) connectLocked() (*publishConn, error) {
+	if rp.current != nil {
+		return rp.current, nil
+	}
+	if time.Now().Before(rp.retryAfter) {
+		return nil, rp.lastDialErr
+	}
+
+	ctx, cancel := context.WithTimeout(rp.ctx, relayDialTimeout)
+	conn, err := nostr.NewConnection(ctx, rp.url, nil, nil)
+	cancel()
+	if err != nil {
+		rp.lastDialErr = fmt.Errorf("failed to connect: %v", err)
+		rp.retryAfter = time.Now().Add(relayReconnectBackoff)
+		return nil, rp.lastDialErr
+	}
+	if rp.verbose {
+		log.Printf("Nostr: Connected to %s for publishing", rp.url)
+	}
+
+	rp.current = &publishConn{conn: conn, pending: make(map[string]chan error)}
+	go rp.read(rp.current)
+	return rp.current, nil
+}
+
+// read dispatches the relay's OK messages until the connection fails, then fails every
+// event still waiting for an answer
+func (rp *relayPublisher) read(pc *publishConn) {
+	buffer := new(bytes.Buffer)
+	for {
+		buffer.Reset()
+		if err := pc.conn.ReadMessage(rp.ctx, buffer); err != nil {
+			rp.disconnect(pc, err)
+			return
+		}
+
+		// Anything else, such as NOTICEs, is of no interest on a connection that only publishes
+		ok, isOK := nostr.ParseMessage(buffer.String()).(*nostr.OKEnvelope)
+		if !isOK {
+			continue
+		}
+		if ok.OK {
+			rp.answer(pc, ok.EventID, nil)
+		} else {
+			rp.answer(pc, ok.EventID, fmt.Errorf("rejected: %s", ok.Reason))
+		}
+	}
+}
+
+// answer reports the outcome of an event sent over pc, unless it was already reported
+func (rp *relayPublisher) answer(pc *publishConn, eventID string, err error) {
+	rp.mutex.Lock()
+	answer, exists := pc.pending[eventID]
+	delete(pc.pending, eventID)
+	rp.mutex.Unlock()
+
+	if exists {
+		rp.finish(answer, err)
+	}
+}
+
+// disconnect drops a failed connection so the next event dials a new one
+func (rp *relayPublisher) disconnect(pc *publishConn, err error) {
+	rp.mutex.Lock()
+	if rp.current == pc {
+		rp.current = nil
+	}
+	pending := pc.pending
+	pc.pending = make(map[string]chan error)
+	rp.mutex.Unlock()
+
+	pc.conn.Close()
+	if rp.verbose && rp.ctx.Err() == nil {
+		log.Printf("Nostr: Lost publishing connection to %s: %v", rp.url, err)
+	}
+	for _, answer := range pending {
+		rp.finish(answer, fmt.Errorf("connection lost before the relay answered: %v", err))
+	}
+}
+
+// finish reports the outcome of one event
+func (rp *relayPublisher) finish(answer chan<- error, err error) {
+	if rp.answered != nil {
+		rp.answered(err)
+	}
+	answer <- err
+}
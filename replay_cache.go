@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultReplayWindow is how far a rumor's timestamp may be from our clock, and so how long
+// its ID has to be remembered. It covers relay delays and modest clock skew between peers
+const defaultReplayWindow = 5 * time.Minute
+
+// replayCache rejects rumors that are stale or were already received. A rumor is accepted
+// only while its created_at is within the window of our clock, and its ID is remembered
+// until then, so a recorded rumor can be replayed neither later nor while still fresh.
+// Every rumor carries a random salt tag, so retransmissions and repeated acks get new IDs
+// even when they are built within the same second and are not affected
+type replayCache struct {
+	mutex     sync.Mutex
+	window    time.Duration
+	seen      map[[32]byte]time.Time // Rumor ID to the time it goes stale
+	nextSweep time.Time
+	rejected  uint64
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window: window,
+		seen:   make(map[[32]byte]time.Time),
+	}
+}
+
+// check records a rumor and returns an error if its timestamp is outside the window or its
+// ID was seen before. The ID must already be verified against the rumor's content
+func (rc *replayCache) check(rumorID string, createdAt time.Time) error {
+	var id [32]byte
+	if len(rumorID) != 2*len(id) {
+		return fmt.Errorf("invalid rumor id %q", rumorID)
+	}
+	if _, err := hex.Decode(id[:], []byte(rumorID)); err != nil {
+		return fmt.Errorf("invalid rumor id %q", rumorID)
+	}
+
+	now := time.Now()
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if age := now.Sub(createdAt); age > rc.window || age < -rc.window {
+		rc.rejected++
+		return fmt.Errorf("stale rumor %s created %v ago, outside the replay window of %v", rumorID, age.Round(time.Second), rc.window)
+	}
+	if _, exists := rc.seen[id]; exists {
+		rc.rejected++
+		return fmt.Errorf("replayed rumor %s", rumorID)
+	}
+
+	// IDs are only needed until their rumor is stale anyway
+	if now.After(rc.nextSweep) {
+		for seenID, staleAt := range rc.seen {
+			if now.After(staleAt) {
+				delete(rc.seen, seenID)
+			}
+		}
+		rc.nextSweep = now.Add(rc.window / 2)
+	}
+	rc.seen[id] = createdAt.Add(rc.window)
+	return nil
+}
+
+// stats returns the number of rejected rumors and of remembered IDs
+func (rc *replayCache) stats() (uint64, int) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.rejected, len(rc.seen)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReplayCache(t *testing.T) {
+	idA := strings.Repeat("a", 64)
+	idB := strings.Repeat("b", 64)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		id        string
+		createdAt time.Time
+		wantErr   bool
+	}{
+		{"fresh", idA, now, false},
+		{"duplicate", idA, now, true},
+		{"other id", idB, now, false},
+		{"too old", strings.Repeat("c", 64), now.Add(-2 * time.Minute), true},
+		{"too far ahead", strings.Repeat("d", 64), now.Add(2 * time.Minute), true},
+		{"skewed within window", strings.Repeat("e", 64), now.Add(-30 * time.Second), false},
+		{"not hex", strings.Repeat("z", 64), now, true},
+		{"too short", "abcd", now, true},
+	}
+
+	cache := newReplayCache(time.Minute)
+	for _, tt := range tests {
+		if err := cache.check(tt.id, tt.createdAt); (err != nil) != tt.wantErr {
+			t.Errorf("%s: check error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+	// Invalid IDs are refused before they count as replays
+	if rejected, remembered := cache.stats(); rejected != 3 || remembered != 3 {
+		t.Errorf("stats() = %d rejected, %d remembered, want 3 and 3", rejected, remembered)
+	}
+}
+
+func TestReplayCacheExpiry(t *testing.T) {
+	window := 50 * time.Millisecond
+	cache := newReplayCache(window)
+	if err := cache.check(strings.Repeat("a", 64), time.Now()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	// Once stale, an ID is swept on a later check and the rumor is refused for its age instead
+	time.Sleep(2 * window)
+	if err := cache.check(strings.Repeat("b", 64), time.Now()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if _, remembered := cache.stats(); remembered != 1 {
+		t.Errorf("%d IDs remembered after the sweep, want 1", remembered)
+	}
+	if err := cache.check(strings.Repeat("a", 64), time.Now().Add(-2*window)); err == nil {
+		t.Error("stale rumor accepted after its ID was forgotten")
+	}
+}
+
+func TestReplayCacheRejectsLongID(t *testing.T) {
+	cache := newReplayCache(time.Minute)
+	if err := cache.check(strings.Repeat("a", 66), time.Now()); err == nil {
+		t.Error("check accepted a 66 character ID")
+	}
+}
+
+func TestRebuiltRumorsHaveDistinctIDs(t *testing.T) {
+	km := newTestKeyManager(t)
+	seen := make(map[string]bool)
+	// Rumors rebuilt within the same second from the same packet, like a retransmission or a repeated ack
+	for i := 0; i < 10; i++ {
+		rumor, err := km.createEphemeralRumor(CreateEmptyPacket(), PacketTypeAck, "session", 0, "client_to_server", "", 0, "", "", RumorFormatJSON, nil, nostr.Tag{"ack", "5"})
+		if err != nil {
+			t.Fatalf("createEphemeralRumor: %v", err)
+		}
+		if seen[rumor.ID] {
+			t.Fatalf("rumor %d has the ID of an earlier one", i)
+		}
+		seen[rumor.ID] = true
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RumorFormat selects how a rumor is serialized before NIP-44 encryption
+type RumorFormat string
+
+const (
+	// RumorFormatJSON is the rumor event as JSON with base64 packet data in its content
+	RumorFormatJSON RumorFormat = "json"
+	// RumorFormatBinary is a length-prefixed JSON header (the rumor without content)
+	// followed by the raw packet data, which avoids encoding the payload twice
+	RumorFormatBinary RumorFormat = "binary"
+)
+
+// binaryRumorMarker starts every binary rumor; JSON rumors always start with '{'
+const binaryRumorMarker = 0x01
+
+// binaryRumorHeaderSize is the marker byte plus the big-endian uint16 header length
+const binaryRumorHeaderSize = 3
+
+// encodeRumor serializes a rumor carrying the given packet data in the requested format.
+// The rumor's ID and signature always cover the base64 content, so both formats describe the same event
+func encodeRumor(rumor *nostr.Event, data []byte, format RumorFormat) ([]byte, error) {
+	if format != RumorFormatBinary {
+		return json.Marshal(rumor)
+	}
+
+	header := *rumor
+	header.Content = ""
+	headerJSON, err := json.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+	if len(headerJSON) > 0xffff {
+		return nil, fmt.Errorf("rumor header too large: %d bytes", len(headerJSON))
+	}
+
+	encoded := make([]byte, binaryRumorHeaderSize, binaryRumorHeaderSize+len(headerJSON)+len(data))
+	encoded[0] = binaryRumorMarker
+	binary.BigEndian.PutUint16(encoded[1:], uint16(len(headerJSON)))
+	encoded = append(encoded, headerJSON...)
+	encoded = append(encoded, data...)
+	return encoded, nil
+}
+
+// decodeRumor parses a decrypted rumor in either format and returns it with its packet data.
+// The content of a binary rumor is left empty; its data is only returned separately
+func decodeRumor(plaintext []byte) (*nostr.Event, []byte, error) {
+	var rumor nostr.Event
+
+	if len(plaintext) == 0 || plaintext[0] != binaryRumorMarker {
+		if err := json.Unmarshal(plaintext, &rumor); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse rumor: %v", err)
+		}
+
+		var data []byte
+		if rumor.Content != "" {
+			decoded, err := base64.StdEncoding.DecodeString(rumor.Content)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to decode base64 content: %v", err)
+			}
+			data = decoded
+		}
+		return &rumor, data, nil
+	}
+
+	if len(plaintext) < binaryRumorHeaderSize {
+		return nil, nil, fmt.Errorf("binary rumor truncated")
+	}
+	headerLen := int(binary.BigEndian.Uint16(plaintext[1:]))
+	if len(plaintext) < binaryRumorHeaderSize+headerLen {
+		return nil, nil, fmt.Errorf("binary rumor header truncated: want %d bytes, have %d", headerLen, len(plaintext)-binaryRumorHeaderSize)
+	}
+	if err := json.Unmarshal(plaintext[binaryRumorHeaderSize:binaryRumorHeaderSize+headerLen], &rumor); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse binary rumor header: %v", err)
+	}
+
+	var data []byte
+	if payload := plaintext[binaryRumorHeaderSize+headerLen:]; len(payload) > 0 {
+		data = payload
+	}
+	return &rumor, data, nil
+}
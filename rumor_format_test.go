@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRumorRoundTrip(t *testing.T) {
+	payloads := map[string][]byte{
+		"empty":  nil,
+		"text":   []byte("hello"),
+		"binary": {0x00, binaryRumorMarker, '{', 0xff},
+		"large":  bytes.Repeat([]byte{0xab}, 70000),
+	}
+
+	for _, format := range []RumorFormat{RumorFormatJSON, RumorFormatBinary} {
+		for name, data := range payloads {
+			t.Run(string(format)+"/"+name, func(t *testing.T) {
+				rumor := &nostr.Event{
+					Kind:    20547,
+					Content: base64.StdEncoding.EncodeToString(data),
+					Tags:    nostr.Tags{{"p", "abc"}, {"type", "data"}},
+				}
+				encoded, err := encodeRumor(rumor, data, format)
+				if err != nil {
+					t.Fatalf("encodeRumor: %v", err)
+				}
+				decoded, decodedData, err := decodeRumor(encoded)
+				if err != nil {
+					t.Fatalf("decodeRumor: %v", err)
+				}
+				if !bytes.Equal(decodedData, data) {
+					t.Errorf("data %d bytes, want %d", len(decodedData), len(data))
+				}
+				if len(data) == 0 && decodedData != nil {
+					t.Error("empty data decoded as non-nil")
+				}
+				if decoded.Kind != rumor.Kind || len(decoded.Tags) != len(rumor.Tags) {
+					t.Errorf("decoded %+v, want %+v", decoded, rumor)
+				}
+				if format == RumorFormatBinary && decoded.Content != "" {
+					t.Error("binary rumor decoded with content")
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeRumorMalformed(t *testing.T) {
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"empty", nil},
+		{"bad json", []byte("{not json")},
+		{"bad base64", []byte(`{"kind":20547,"content":"!!!"}`)},
+		{"binary marker only", []byte{binaryRumorMarker}},
+		{"binary short length", []byte{binaryRumorMarker, 0x00}},
+		{"binary header truncated", []byte{binaryRumorMarker, 0x00, 0x10, '{', '}'}},
+		{"binary bad header", []byte{binaryRumorMarker, 0x00, 0x02, '{', '!'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rumor, _, err := decodeRumor(tt.plaintext); err == nil {
+				t.Errorf("decodeRumor(%q) = %+v, want an error", tt.plaintext, rumor)
+			}
+		})
+	}
+}
+
+func TestEncodeRumorHeaderTooLarge(t *testing.T) {
+	rumor := &nostr.Event{Kind: 20547, Tags: nostr.Tags{{"padding", string(bytes.Repeat([]byte("0"), 0x10000))}}}
+	if _, err := encodeRumor(rumor, nil, RumorFormatBinary); err == nil {
+		t.Error("encodeRumor accepted a header longer than 65535 bytes")
+	}
+}
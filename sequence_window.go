@@ -0,0 +1,52 @@
+package main
+
+// sequenceWindowSize is how many sequences at and beyond the next expected one a receiver
+// tracks. Senders keep at most maxInflightPackets unacknowledged, so this leaves ample room
+const sequenceWindowSize = 1024
+
+// sequenceWindow records which sequences of one direction have been received using a
+// cumulative base and a fixed-size bitmap, so its memory stays flat however long the
+// session lives. Every sequence below base has been received; the bitmap is a ring
+// covering base to base+sequenceWindowSize-1
+type sequenceWindow struct {
+	base uint64
+	bits [sequenceWindowSize / 64]uint64
+}
+
+// inWindow reports whether seq can be tracked, i.e. it is neither below base nor too far ahead
+func (sw *sequenceWindow) inWindow(seq uint64) bool {
+	return seq >= sw.base && seq-sw.base < sequenceWindowSize
+}
+
+// seen reports whether seq has already been received
+func (sw *sequenceWindow) seen(seq uint64) bool {
+	if seq < sw.base {
+		return true
+	}
+	if !sw.inWindow(seq) {
+		return false
+	}
+	slot := seq % sequenceWindowSize
+	return sw.bits[slot/64]&(1<<(slot%64)) != 0
+}
+
+// mark records seq as received; it returns false if seq lies beyond the window
+func (sw *sequenceWindow) mark(seq uint64) bool {
+	if !sw.inWindow(seq) {
+		return false
+	}
+	slot := seq % sequenceWindowSize
+	sw.bits[slot/64] |= 1 << (slot % 64)
+	return true
+}
+
+// advance moves base past every consecutively received sequence, freeing their slots,
+// and returns the new base
+func (sw *sequenceWindow) advance() uint64 {
+	for sw.seen(sw.base) {
+		slot := sw.base % sequenceWindowSize
+		sw.bits[slot/64] &^= 1 << (slot % 64)
+		sw.base++
+	}
+	return sw.base
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestSequenceWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		marks    []uint64
+		wantBase uint64
+		seen     []uint64
+		unseen   []uint64
+	}{
+		{"empty", nil, 0, nil, []uint64{0, 1}},
+		{"in order", []uint64{0, 1, 2}, 3, []uint64{0, 1, 2}, []uint64{3}},
+		{"gap holds base", []uint64{0, 2, 3}, 1, []uint64{0, 2, 3}, []uint64{1, 4}},
+		{"gap filled", []uint64{2, 1, 0}, 3, []uint64{0, 1, 2}, []uint64{3}},
+		{"duplicates", []uint64{0, 0, 1, 1}, 2, []uint64{0, 1}, []uint64{2}},
+		{"last slot", []uint64{sequenceWindowSize - 1}, 0, []uint64{sequenceWindowSize - 1}, []uint64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sw sequenceWindow
+			for _, seq := range tt.marks {
+				if !sw.mark(seq) {
+					t.Fatalf("mark(%d) rejected", seq)
+				}
+			}
+			if base := sw.advance(); base != tt.wantBase {
+				t.Errorf("advance() = %d, want %d", base, tt.wantBase)
+			}
+			for _, seq := range tt.seen {
+				if !sw.seen(seq) {
+					t.Errorf("seen(%d) = false, want true", seq)
+				}
+			}
+			for _, seq := range tt.unseen {
+				if sw.seen(seq) {
+					t.Errorf("seen(%d) = true, want false", seq)
+				}
+			}
+		})
+	}
+}
+
+func TestSequenceWindowLimits(t *testing.T) {
+	var sw sequenceWindow
+	if sw.mark(sequenceWindowSize) {
+		t.Errorf("mark(%d) accepted beyond the window", sequenceWindowSize)
+	}
+
+	// Slots freed by advance are reused for the sequences a window further on
+	for seq := uint64(0); seq < sequenceWindowSize; seq++ {
+		sw.mark(seq)
+	}
+	if base := sw.advance(); base != sequenceWindowSize {
+		t.Fatalf("advance() = %d, want %d", base, sequenceWindowSize)
+	}
+	if sw.seen(sequenceWindowSize) {
+		t.Errorf("seen(%d) = true after its slot was freed", sequenceWindowSize)
+	}
+	if !sw.seen(5) {
+		t.Error("seen(5) = false below base")
+	}
+	if sw.mark(5) {
+		t.Error("mark(5) accepted below base")
+	}
+	if !sw.mark(2*sequenceWindowSize - 1) {
+		t.Errorf("mark(%d) rejected at the end of the window", 2*sequenceWindowSize-1)
+	}
+}
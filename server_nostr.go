@@ -1,14 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func runServerNostr(targetHost string, targetPort int, relayURLs []string, privateKey string, verbose bool) {
+func runServerNostr(targetHost string, targetPort int, relayURLs []string, privateKey string, keyPoolSize, keyMaxUses int, replayWindow time.Duration, allowedClients *ClientAllowlist, sessionConfig *SessionConfig, verbose bool) {
 	// Show startup banner
 	fmt.Print(GetBanner())
 
@@ -19,13 +24,42 @@ func runServerNostr(targetHost string, targetPort int, relayURLs []string, priva
 
 	targetAddr := fmt.Sprintf("%s:%d", targetHost, targetPort)
 
+	// Stay within the message size every relay accepts
+	sessionConfig.MaxEventSize = discoverMaxEventSize(relayURLs, sessionConfig.MaxEventSize, verbose)
+
 	fmt.Printf("Starting TCP proxy server (Nostr mode):\n")
 	fmt.Printf("  Target: %s\n", targetAddr)
 	fmt.Printf("  Relay URLs: %v\n", relayURLs)
+	if allowedClients != nil {
+		fmt.Printf("  Allowed clients: %d\n", allowedClients.Len())
+	} else {
+		fmt.Printf("  Allowed clients: any\n")
+	}
+	fmt.Printf("  Gap timeout: %v\n", sessionConfig.GapTimeout)
+	fmt.Printf("  Heartbeat interval: %v (peer timeout %v)\n", sessionConfig.HeartbeatInterval, sessionConfig.PeerTimeout)
+	fmt.Printf("  Resume grace: %v\n", sessionConfig.ResumeGrace)
+	fmt.Printf("  Max event size: %d bytes\n", sessionConfig.MaxEventSize)
+	if sessionConfig.CoalesceDelay > 0 {
+		fmt.Printf("  Write coalescing: up to %v\n", sessionConfig.CoalesceDelay)
+	} else {
+		fmt.Printf("  Write coalescing: off (no-delay)\n")
+	}
+	fmt.Printf("  Compression: %s\n", sessionConfig.Compression)
+	if len(sessionConfig.PaddingBuckets) > 0 {
+		fmt.Printf("  Padding: to %s bytes\n", sessionConfig.PaddingBuckets)
+	} else {
+		fmt.Printf("  Padding: off\n")
+	}
+	if sessionConfig.CoverInterval > 0 {
+		fmt.Printf("  Cover traffic: every %v\n", sessionConfig.CoverInterval)
+	} else {
+		fmt.Printf("  Cover traffic: off\n")
+	}
 	fmt.Printf("  Verbose logging: %t\n\n", verbose)
 
 	// Initialize key manager
-	keyMgr := NewKeyManager("")
+	keyMgr := NewKeyManager("", keyPoolSize, keyMaxUses, replayWindow)
+	defer keyMgr.Close()
 	if privateKey != "" {
 		// Use provided private key
 		if err := keyMgr.LoadKeysFromPrivateKey(privateKey); err != nil {
@@ -66,102 +100,103 @@ func runServerNostr(targetHost string, targetPort int, relayURLs []string, priva
 	fmt.Printf("TCP proxy server started successfully. Monitoring for Nostr events...\n\n")
 
 	// Monitor for new session events
-	monitorNostrSessionEvents(relayHandler, keyMgr, serverKeys.PublicKey, targetAddr, verbose)
+	monitorNostrSessionEvents(relayHandler, keyMgr, serverKeys.PublicKey, targetAddr, allowedClients, sessionConfig, verbose)
 }
 
-func monitorNostrSessionEvents(relayHandler *NostrRelayHandler, keyMgr *KeyManager, serverPubkey, targetAddr string, verbose bool) {
-	activeSessions := make(map[string]chan bool)            // sessionID -> done channel
-	sessionEventChans := make(map[string]chan *nostr.Event) // sessionID -> event channel
+func monitorNostrSessionEvents(relayHandler *NostrRelayHandler, keyMgr *KeyManager, serverPubkey, targetAddr string, allowedClients *ClientAllowlist, sessionConfig *SessionConfig, verbose bool) {
+	// The router decrypts every event once and hands sessions their packets
+	router := NewSessionRouter(relayHandler, keyMgr, serverPubkey, "client_to_server", verbose)
+
+	// An open for an unknown session starts a new session handler. The open itself is
+	// dispatched to it too, so the session acknowledges it (and re-acknowledges retransmitted opens)
+	router.OnOpen(func(parsedPacket *ParsedPacket) {
+		// Clients that are not allowed get their reject without a session being set up, so
+		// they can't make us hold a queue, a session and a goroutine per open
+		if !allowedClients.Allows(parsedPacket.ClientPubkey) {
+			log.Printf("Server: Session %s - Denied session from client %s, not in allowed clients", parsedPacket.SessionID, parsedPacket.ClientPubkey)
+			go denyOpen(relayHandler, keyMgr, parsedPacket, sessionConfig, verbose)
+			return
+		}
 
-	for { //nolint:gosimple // This is an event loop, not a range iteration
-		select {
-		case event := <-relayHandler.GetEventChannel():
-			// Check if this event is for us
-			if !IsEventForMe(event, serverPubkey) {
-				continue
+		if verbose {
+			if parsedPacket.ClientAddr != "" {
+				log.Printf("Server: New session %s from client %s (local client %s)", parsedPacket.SessionID, parsedPacket.ClientPubkey, parsedPacket.ClientAddr)
+			} else {
+				log.Printf("Server: New session %s from client %s", parsedPacket.SessionID, parsedPacket.ClientPubkey)
 			}
+		}
 
-			// Version compatibility is now checked in UnwrapEphemeralGiftWrap
-
-			// Parse encrypted gift wrapped event
-			parsedPacket, err := keyMgr.UnwrapEphemeralGiftWrap(event)
-			if err != nil {
-				if verbose {
-					log.Printf("Server: Error unwrapping encrypted event: %v", err)
-				}
-				continue
-			}
+		// Bind the session to the client pubkey from the signed rumor, not the one-time pubkey
+		// from the gift wrap, so no other client can inject packets into it
+		packetChan := router.Register(parsedPacket.SessionID, parsedPacket.ClientPubkey)
+		go func(sessionID, clientPubkey string) {
+			defer router.Unregister(sessionID)
+			handleServerNostrSessionWithEvents(relayHandler, keyMgr, sessionID, clientPubkey, targetAddr, packetChan, sessionConfig, verbose)
 
-			// Only handle client_to_server packets
-			if parsedPacket.Direction != "client_to_server" {
-				continue
+			if verbose {
+				log.Printf("Server: Session %s completed and cleaned up", sessionID)
+				hits, misses, size := keyMgr.ReceiveKeyCacheStats()
+				log.Printf("Server: Conversation key cache: %d hits, %d misses, %d keys", hits, misses, size)
+				ready, generatedInline := keyMgr.KeyPoolStats()
+				log.Printf("Server: One-time key pool: %d keys ready, %d generated inline", ready, generatedInline)
+				rejected, remembered := keyMgr.ReplayStats()
+				log.Printf("Server: Replay protection: %d rumors rejected, %d ids remembered", rejected, remembered)
 			}
+		}(parsedPacket.SessionID, parsedPacket.ClientPubkey)
+	})
 
-			// Check if this is an open packet for a new session
-			if parsedPacket.Type == PacketTypeOpen {
-				// Check if we already have this session
-				if _, exists := activeSessions[parsedPacket.SessionID]; exists {
-					continue // Session already active
-				}
+	router.Run()
+}
 
-				if verbose {
-					log.Printf("Server: New session %s from client", parsedPacket.SessionID)
-				}
+// targetDialTimeout bounds how long a session waits for the target to accept the connection
+const targetDialTimeout = 10 * time.Second
+
+// classifyDialError maps a failed target dial to the error code reported to the client.
+// Only the innermost error is passed on so the target address is not revealed
+func classifyDialError(err error) *TunnelError {
+	code := ErrorCodeUnreachable
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		code = ErrorCodeRefused
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		code = ErrorCodeDenied
+	case errors.As(err, &netErr) && netErr.Timeout():
+		code = ErrorCodeTimeout
+	}
 
-				// Create session-specific event channel
-				sessionEventChan := make(chan *nostr.Event, 100)
-				sessionEventChans[parsedPacket.SessionID] = sessionEventChan
-
-				// Start new session handler with its own event channel
-				// Use the real client pubkey from the rumor, not the one-time pubkey from gift wrap
-				done := make(chan bool)
-				activeSessions[parsedPacket.SessionID] = done
-				go handleServerNostrSessionWithEvents(keyMgr, parsedPacket.SessionID, parsedPacket.ClientPubkey, targetAddr, relayHandler.GetRelayURLs(), sessionEventChan, done, verbose)
-
-				// Clean up when session is done
-				go func(sessionID string, doneChan chan bool) {
-					<-doneChan
-					delete(activeSessions, sessionID)
-					if sessionEventChan, exists := sessionEventChans[sessionID]; exists {
-						close(sessionEventChan)
-						delete(sessionEventChans, sessionID)
-					}
-					if verbose {
-						log.Printf("Server: Session %s completed and cleaned up", sessionID)
-					}
-				}(parsedPacket.SessionID, done)
-			} else {
-				// This is a data/close packet for an existing session
-				if sessionEventChan, exists := sessionEventChans[parsedPacket.SessionID]; exists {
-					select {
-					case sessionEventChan <- event:
-						// Successfully forwarded to session handler
-					default:
-						if verbose {
-							log.Printf("Server: Session %s event channel full, dropping event", parsedPacket.SessionID)
-						}
-					}
-				} else {
-					if verbose {
-						log.Printf("Server: Received event for unknown session %s", parsedPacket.SessionID)
-					}
-				}
-			}
-		}
+	detail := err.Error()
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		detail = opErr.Err.Error()
 	}
+	return &TunnelError{Code: code, Detail: detail}
 }
 
-func handleServerNostrSessionWithEvents(keyMgr *KeyManager, sessionID, clientPubkey, targetAddr string, relayURLs []string, eventChan <-chan *nostr.Event, done chan bool, verbose bool) {
-	defer func() { done <- true }()
-
+func handleServerNostrSessionWithEvents(relayHandler *NostrRelayHandler, keyMgr *KeyManager, sessionID, clientPubkey, targetAddr string, packetChan <-chan *ParsedPacket, sessionConfig *SessionConfig, verbose bool) {
 	if verbose {
 		log.Printf("Server: Starting session %s with client %s", sessionID, clientPubkey)
 	}
 
+	// Responses go out through the server's shared relay pool, queued per session.
+	// The session exists before the target is dialed so a dial failure can be reported to the client
+	session := NewTunnelSession(sessionID, "Server", relayHandler, keyMgr, clientPubkey, "server_to_client", "", sessionConfig, verbose)
+	defer session.Close()
+
+	// Feed the packets the router decrypted for this session into the session
+	go session.Feed(packetChan)
+
+	// Our answer has to echo the nonce announced in the client's open
+	if err := awaitOpen(session); err != nil {
+		log.Printf("Server: Session %s - Did not receive open: %v", sessionID, err)
+		return
+	}
+
 	// Connect to target
-	targetConn, err := net.Dial("tcp", targetAddr)
+	targetConn, err := net.DialTimeout("tcp", targetAddr, targetDialTimeout)
 	if err != nil {
 		log.Printf("Server: Session %s - Failed to connect to target %s: %v", sessionID, targetAddr, err)
+		rejectOpen(session, sessionID, classifyDialError(err))
 		return
 	}
 	defer targetConn.Close()
@@ -170,113 +205,149 @@ func handleServerNostrSessionWithEvents(keyMgr *KeyManager, sessionID, clientPub
 		log.Printf("Server: Session %s - Connected to target %s", sessionID, targetAddr)
 	}
 
-	// Create relay handler for this session's responses
-	relayHandler, err := NewNostrRelayHandler(relayURLs, keyMgr, verbose)
-	if err != nil {
-		log.Printf("Server: Session %s - Failed to create relay handler: %v", sessionID, err)
+	// Accept the open; the client holds its data until this arrives
+	acceptTags := append(session.HandshakeTags(), nostr.Tag{"status", "accept"})
+	if err := session.Send(PacketTypeOpenAck, nil, acceptTags...); err != nil {
+		if err != ErrSessionClosed {
+			log.Printf("Server: Session %s - Failed to send open_ack: %v", sessionID, err)
+		}
 		return
 	}
-	defer relayHandler.Close()
 
 	// Start goroutine to read responses from target
 	targetDone := make(chan bool, 1)
-	go readTargetNostrResponses(relayHandler, keyMgr, sessionID, clientPubkey, targetConn, targetDone, verbose)
+	go readTargetNostrResponses(session, sessionID, targetConn, targetDone, verbose)
 
-	processedSequences := make(map[uint64]bool)
-	nextExpectedSequence := uint64(1)                // Start at 1 since open packet (seq 0) was already handled
-	pendingPackets := make(map[uint64]*ParsedPacket) // Buffer for out-of-order packets
-
-	// Mark the open packet (seq 0) as already processed
-	processedSequences[0] = true
+	// The session ends once both directions are finished: the target sent EOF and
+	// we forwarded a fin, and the client sent a fin that we passed on as a half-close
+	targetFinished := false
+	clientFinished := false
 
 	// Handle incoming packets for this session
 	for {
 		select {
-		case <-targetDone:
-			if verbose {
-				log.Printf("Server: Session %s - Target connection closed", sessionID)
-			}
-			return
-		case event := <-eventChan:
-			// Events from this channel are already filtered for this session
-
-			// Version compatibility is now checked in UnwrapEphemeralGiftWrap
-
-			parsedPacket, err := keyMgr.UnwrapEphemeralGiftWrap(event)
-			if err != nil {
+		case halfClosed := <-targetDone:
+			if !halfClosed {
 				if verbose {
-					log.Printf("Server: Session %s - Error unwrapping encrypted packet: %v", sessionID, err)
+					log.Printf("Server: Session %s - Target connection closed", sessionID)
 				}
-				continue
+				return
 			}
-
-			// Skip if already processed
-			if processedSequences[parsedPacket.Sequence] {
-				continue
+			if verbose {
+				log.Printf("Server: Session %s - Target finished sending", sessionID)
 			}
-
-			// Check sequence order - if not the next expected, buffer it
-			if parsedPacket.Sequence != nextExpectedSequence {
-				pendingPackets[parsedPacket.Sequence] = parsedPacket
-				if verbose {
-					log.Printf("Server: Session %s - Buffering out-of-order packet seq %d (expecting %d)", sessionID, parsedPacket.Sequence, nextExpectedSequence)
-				}
-				continue
+			targetFinished = true
+			targetDone = nil
+			if clientFinished {
+				return
 			}
-
-			// Process this packet and any consecutive buffered packets
-			packetsToProcess := []*ParsedPacket{parsedPacket}
-
-			// Collect consecutive packets from buffer
-			seq := nextExpectedSequence + 1
-			for {
-				if bufferedPacket, exists := pendingPackets[seq]; exists {
-					packetsToProcess = append(packetsToProcess, bufferedPacket)
-					delete(pendingPackets, seq)
-					seq++
-				} else {
-					break
+		case pkt, ok := <-session.Incoming():
+			if !ok {
+				if err := session.Err(); err != nil {
+					log.Printf("Server: Session %s - Session aborted: %v", sessionID, err)
 				}
+				return
 			}
 
-			// Process all packets in order
-			for _, pkt := range packetsToProcess {
-				// Mark as processed
-				processedSequences[pkt.Sequence] = true
-
-				// Process packet based on type
-				switch pkt.Type {
-				case PacketTypeData:
-					// Write data to target connection
-					if len(pkt.Packet.Data) > 0 {
-						if _, writeErr := targetConn.Write(pkt.Packet.Data); writeErr != nil {
-							log.Printf("Server: Session %s - Error writing to target: %v", sessionID, writeErr)
-							return
-						}
-
-						if verbose {
-							log.Printf("Server: Session %s - Forwarded %d bytes to target (seq %d)", sessionID, len(pkt.Packet.Data), pkt.Sequence)
+			// Packets arrive reordered and deduplicated by the session
+			switch pkt.Type {
+			case PacketTypeData:
+				// Write data to target connection
+				if len(pkt.Packet.Data) > 0 {
+					if _, writeErr := targetConn.Write(pkt.Packet.Data); writeErr != nil {
+						log.Printf("Server: Session %s - Error writing to target: %v", sessionID, writeErr)
+						if err := session.Send(PacketTypeClose, nil); err != nil && err != ErrSessionClosed {
+							log.Printf("Server: Session %s - Failed to send encrypted close packet: %v", sessionID, err)
 						}
+						return
 					}
 
-				case PacketTypeClose:
 					if verbose {
-						log.Printf("Server: Session %s - Received close packet from client", sessionID)
+						log.Printf("Server: Session %s - Forwarded %d bytes to target (seq %d)", sessionID, len(pkt.Packet.Data), pkt.Sequence)
 					}
+				}
+
+			case PacketTypeFin:
+				// The client finished sending; pass the half-close on to the target
+				if verbose {
+					log.Printf("Server: Session %s - Received fin packet from client", sessionID)
+				}
+				if err := closeWrite(targetConn); err != nil && verbose {
+					log.Printf("Server: Session %s - Error half-closing target connection: %v", sessionID, err)
+				}
+				clientFinished = true
+				if targetFinished {
 					return
 				}
 
-				// Update next expected sequence
-				nextExpectedSequence = pkt.Sequence + 1
+			case PacketTypeClose:
+				if pkt.ErrorMsg != "" {
+					log.Printf("Server: Session %s - Client closed session with error: %s (%s)", sessionID, pkt.ErrorMsg, pkt.ErrorCode)
+				} else if verbose {
+					log.Printf("Server: Session %s - Received close packet from client", sessionID)
+				}
+				return
 			}
 		}
 	}
 }
 
-func readTargetNostrResponses(relayHandler *NostrRelayHandler, keyMgr *KeyManager, sessionID, clientPubkey string, targetConn net.Conn, done chan bool, verbose bool) {
-	defer func() { done <- true }()
+// awaitOpen waits until the session has received the client's open, which is the first
+// packet of its direction and announces the client's session parameters
+func awaitOpen(session *TunnelSession) error {
+	pkt, ok := <-session.Incoming()
+	if !ok {
+		if err := session.Err(); err != nil {
+			return err
+		}
+		return ErrSessionClosed
+	}
+	if pkt.Type != PacketTypeOpen {
+		err := fmt.Errorf("unexpected %s packet before open", pkt.Type)
+		session.Abort(err)
+		return err
+	}
+	return nil
+}
+
+// rejectOpen answers the client's open with a rejection carrying the reason. The caller's
+// Close then waits for the client to acknowledge it
+func rejectOpen(session *TunnelSession, sessionID string, reason *TunnelError) {
+	rejectTags := append(session.HandshakeTags(), nostr.Tag{"status", "reject"}, errorTag(reason))
+	if err := session.Send(PacketTypeOpenAck, nil, rejectTags...); err != nil && err != ErrSessionClosed {
+		log.Printf("Server: Session %s - Failed to send open_ack: %v", sessionID, err)
+	}
+}
+
+// denyOpen answers the open of a client that is not allowed with a reject open_ack. The reply
+// is a one-off packet that acknowledges the open and echoes its nonce, which is all the client
+// needs to accept it; a retransmitted open is simply denied again
+func denyOpen(relayHandler *NostrRelayHandler, keyMgr *KeyManager, open *ParsedPacket, sessionConfig *SessionConfig, verbose bool) {
+	publishQueue := NewPublishQueue(relayHandler, fmt.Sprintf("Server: Session %s", open.SessionID), verbose)
+	defer publishQueue.Close()
+
+	format := RumorFormatJSON
+	if open.Format == RumorFormatBinary {
+		format = RumorFormatBinary
+	}
+	rejectTags := nostr.Tags{
+		{"ack", strconv.FormatUint(open.Sequence+1, 10)},
+		{"window", "0"},
+		{"peer_nonce", open.Nonce},
+		{"status", "reject"},
+		errorTag(&TunnelError{Code: ErrorCodeDenied, Detail: "client not allowed"}),
+	}
+	if err := SendNostrPacket(publishQueue, keyMgr, CreateEmptyPacket(), open.ClientPubkey, PacketTypeOpenAck, open.SessionID, 0, "server_to_client", "", 0, "", "", format, sessionConfig.PaddingBuckets, verbose, nil, rejectTags...); err != nil {
+		log.Printf("Server: Session %s - Failed to send open_ack: %v", open.SessionID, err)
+	}
+}
+
+// readTargetNostrResponses forwards the target's data to the client. On EOF it sends a fin
+// and reports true on done; on any other end of the connection it closes the session and reports false
+func readTargetNostrResponses(session *TunnelSession, sessionID string, targetConn net.Conn, done chan bool, verbose bool) {
+	halfClosed := false
+	defer func() { done <- halfClosed }()
 
-	sequence := uint64(0)         // Server starts its own sequence at 0
 	buffer := make([]byte, 32768) // Increased from 4KB to 32KB for better throughput
 	// This reduces the number of Nostr events by 8x, significantly improving performance with remote relays
 
@@ -286,31 +357,39 @@ func readTargetNostrResponses(relayHandler *NostrRelayHandler, keyMgr *KeyManage
 			if verbose {
 				log.Printf("Server: Session %s - Target connection closed: %v", sessionID, err)
 			}
+			halfClosed = err == io.EOF
 			break
 		}
 
 		if n > 0 {
-			// Create data packet
-			dataPacket := CreateDataPacket(buffer[:n])
-			if err := SendNostrPacket(relayHandler, keyMgr, dataPacket, clientPubkey, PacketTypeData, sessionID, sequence, "server_to_client", "", 0, "", "", verbose); err != nil {
-				log.Printf("Server: Session %s - Failed to send encrypted data packet: %v", sessionID, err)
-				break
+			if err := session.Send(PacketTypeData, buffer[:n]); err != nil {
+				if err != ErrSessionClosed {
+					log.Printf("Server: Session %s - Failed to send encrypted data packet: %v", sessionID, err)
+				}
+				return
 			}
 
 			if verbose {
-				log.Printf("Server: Session %s - Sent %d bytes to client via encrypted event (seq %d)", sessionID, n, sequence)
+				log.Printf("Server: Session %s - Sent %d bytes to client via encrypted event", sessionID, n)
 			}
-			sequence++
 		}
 	}
 
-	// Send close packet synchronously to ensure proper cleanup
-	closePacket := CreateEmptyPacket()
-	if err := SendNostrPacketSync(relayHandler, keyMgr, closePacket, clientPubkey, PacketTypeClose, sessionID, sequence, "server_to_client", "", 0, "", "", verbose); err != nil {
-		log.Printf("Server: Session %s - Failed to send encrypted close packet: %v", sessionID, err)
+	// Send fin on a clean EOF so the client can keep sending, otherwise close the whole session;
+	// the session handler waits for it to be acknowledged
+	packetType := PacketTypeClose
+	if halfClosed {
+		packetType = PacketTypeFin
+	}
+	if err := session.Send(packetType, nil); err != nil {
+		if err != ErrSessionClosed {
+			log.Printf("Server: Session %s - Failed to send encrypted %s packet: %v", sessionID, packetType, err)
+		}
+		halfClosed = false
+		return
 	}
 
 	if verbose {
-		log.Printf("Server: Session %s - Sent encrypted close packet to client", sessionID)
+		log.Printf("Server: Session %s - Sent encrypted %s packet to client", sessionID, packetType)
 	}
 }
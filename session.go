@@ -0,0 +1,1219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Reliability tuning
+const (
+	initialRTO        = 1 * time.Second        // RTO before the first RTT sample (RFC 6298)
+	minRTO            = 500 * time.Millisecond // Relays add latency, so never go below this
+	maxRTO            = 30 * time.Second       // Upper bound for exponential backoff
+	maxRetransmits    = 8                      // Retransmissions of one packet before the session fails
+	retransmitTick    = 100 * time.Millisecond // How often the retransmit buffer is scanned
+	ackDelay          = 100 * time.Millisecond // Delayed ack for in-order packets
+	maxSelectiveAcks  = 32                     // Upper bound of sequences listed in one sack tag
+	sessionLingerTime = 5 * time.Second        // How long Close waits for outstanding packets to be acked
+
+	peerTimeoutHeartbeats = 3 // Peer heartbeat intervals that must fit in the peer timeout
+)
+
+// Flow control tuning
+const (
+	receiveWindowSize  = 512 * 1024 // Bytes of received data we are willing to buffer per session
+	initialPeerWindow  = 64 * 1024  // Credit assumed before the peer advertises its window
+	maxInflightPackets = 64         // Unacknowledged packets per session, bounding concurrent publishes
+)
+
+// ErrSessionClosed is returned when sending on a session that has already ended
+var ErrSessionClosed = errors.New("session closed")
+
+// Error codes carried in the error tag of close packets
+const (
+	ErrorCodeRefused     = "refused"     // The target refused the connection
+	ErrorCodeTimeout     = "timeout"     // The target did not answer in time
+	ErrorCodeUnreachable = "unreachable" // The target host or network could not be reached
+	ErrorCodeDenied      = "denied"      // The connection is not permitted
+	ErrorCodeSession     = "session"     // The tunnel session itself failed
+)
+
+// TunnelError is a session failure reported to the peer with an error code
+type TunnelError struct {
+	Code   string
+	Detail string
+}
+
+func (te *TunnelError) Error() string {
+	return te.Code + ": " + te.Detail
+}
+
+// errorTag builds the ["error", code, detail] tag of the close packet sent because of err
+func errorTag(err error) nostr.Tag {
+	var tunnelErr *TunnelError
+	if errors.As(err, &tunnelErr) {
+		return nostr.Tag{"error", tunnelErr.Code, tunnelErr.Detail}
+	}
+	return nostr.Tag{"error", ErrorCodeSession, err.Error()}
+}
+
+// SessionConfig holds the tunable timeouts and limits of tunnel sessions
+type SessionConfig struct {
+	GapTimeout        time.Duration  // How long a missing sequence may hold back buffered packets
+	MaxBufferedBytes  int            // Out-of-order data buffered per session before it is aborted
+	HeartbeatInterval time.Duration  // Idle time after which a heartbeat is sent to the peer
+	PeerTimeout       time.Duration  // Silence from the peer after which the session is suspended
+	ResumeGrace       time.Duration  // How long a suspended session waits for the peer; zero aborts right away
+	MaxEventSize      int            // Largest gift wrap we publish; bigger data is fragmented
+	CoalesceDelay     time.Duration  // How long data may wait to fill a packet while data is in flight; zero sends at once
+	CoalesceSize      int            // Data bytes that fill a packet; zero means as much as fits in one event
+	Compression       Compression    // Payload compression offered to the peer; CompressionNone disables it
+	ForwardClientAddr bool           // Whether clients tell the server their local client's address in the open
+	PaddingBuckets    PaddingBuckets // Sizes rumors are padded to; empty disables padding
+	CoverInterval     time.Duration  // How often a dummy packet is sent as cover traffic; zero disables it
+	Stats             *SessionStats  // Packet counters shared by all sessions, nil if not collected
+}
+
+// SessionStats counts packets across all sessions using one SessionConfig
+type SessionStats struct {
+	PacketsSent     atomic.Uint64 // Sequenced packets sent for the first time
+	Retransmissions atomic.Uint64 // Sequenced packets sent again because no ack arrived in time
+	Duplicates      atomic.Uint64 // Sequenced packets received more than once
+}
+
+// DefaultSessionConfig returns the session configuration used when no flags override it
+func DefaultSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		GapTimeout:        30 * time.Second,
+		MaxBufferedBytes:  4 * 1024 * 1024,
+		HeartbeatInterval: 15 * time.Second,
+		PeerTimeout:       60 * time.Second,
+		ResumeGrace:       5 * time.Minute,
+		MaxEventSize:      defaultMaxEventSize,
+		CoalesceDelay:     20 * time.Millisecond,
+		Compression:       CompressionDeflate,
+	}
+}
+
+// outboundPacket is a sent packet kept in the retransmit buffer until acknowledged
+type outboundPacket struct {
+	packetType PacketType
+	data       []byte
+	extraTags  nostr.Tags
+	sentAt     time.Time
+	retries    int
+}
+
+// rtoEstimator computes the retransmission timeout from RTT samples as in RFC 6298
+type rtoEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	sampled bool
+}
+
+func newRTOEstimator() *rtoEstimator {
+	return &rtoEstimator{rto: initialRTO}
+}
+
+// sample feeds one round-trip measurement into the estimator
+func (re *rtoEstimator) sample(rtt time.Duration) {
+	if !re.sampled {
+		re.srtt = rtt
+		re.rttvar = rtt / 2
+		re.sampled = true
+	} else {
+		delta := re.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		re.rttvar = (3*re.rttvar + delta) / 4
+		re.srtt = (7*re.srtt + rtt) / 8
+	}
+
+	re.rto = re.srtt + 4*re.rttvar
+	if re.rto < minRTO {
+		re.rto = minRTO
+	}
+	if re.rto > maxRTO {
+		re.rto = maxRTO
+	}
+}
+
+// timeout returns the RTO for a packet that has already been retransmitted the given number of times
+func (re *rtoEstimator) timeout(retries int) time.Duration {
+	rto := re.rto
+	for i := 0; i < retries && rto < maxRTO; i++ {
+		rto *= 2
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
+
+// TunnelSession is the reliable packet stream of one tunneled connection.
+// It numbers outgoing packets, keeps them in a retransmit buffer until the peer
+// acknowledges them, and reorders incoming packets before handing them to the
+// connection handler through Incoming
+type TunnelSession struct {
+	id           string
+	role         string        // "Client" or "Server", used as log prefix
+	publishQueue *PublishQueue // This session's queue on top of the shared relay pool
+	keyMgr       *KeyManager
+	peerPubkey   string
+	direction    string         // Direction of the packets we send
+	clientAddr   string         // Sent in the open only, empty to keep it from the peer
+	padding      PaddingBuckets // config.PaddingBuckets limited to what fits in one event
+	config       *SessionConfig
+	verbose      bool
+
+	// Session nonces: ours is announced in our handshake and must be echoed in every later
+	// packet from the peer, and we echo the peer's, so packets recorded from an earlier
+	// session with the same ID are rejected
+	nonce     string
+	peerNonce string // Learned from the peer's handshake, guarded by mutex
+
+	mutex     sync.Mutex
+	sendMutex sync.Mutex // Serializes Send so the fragments of one chunk get consecutive sequences
+
+	// Coalescing, guarded by sendMutex
+	coalesced     []byte      // Data waiting to fill a packet
+	coalesceTimer *time.Timer // Flushes coalesced after CoalesceDelay, nil if not running
+
+	// Send side
+	nextSequence  uint64
+	unacked       map[uint64]*outboundPacket // Retransmit buffer keyed by sequence
+	rto           *rtoEstimator
+	ackedSignal   chan struct{} // Notified whenever the retransmit buffer shrinks
+	inflightBytes int           // Data bytes in the retransmit buffer
+	peerWindow    int           // Credit last advertised by the peer
+	sendFormat    RumorFormat   // Rumor format the peer announced it can receive
+	compress      bool          // Whether both sides offered deflate, so data chunks are compressed
+	windowSignal  chan struct{} // Notified whenever acks or window updates may let Send proceed
+
+	// Liveness
+	lastSent     time.Time     // Last time any packet went to the peer
+	lastReceived time.Time     // Last time any packet arrived from the peer
+	peerSeen     bool          // Set once anything arrived from the peer; until then a silent peer is never suspended for
+	nextCover    time.Time     // When the next cover packet is due, if cover traffic is enabled
+	peerTimeout  time.Duration // PeerTimeout, raised if the peer announces a long heartbeat interval
+
+	// Set while the peer is unreachable, e.g. during a relay outage; zero when active
+	suspendedSince time.Time
+
+	// Receive side
+	received             sequenceWindow           // Sequences received so far; its base is the next expected sequence
+	pendingPackets       map[uint64]*ParsedPacket // Buffer for out-of-order packets
+	reassembly           reassembler              // Fragments of a chunk delivered so far
+	receivedAny          bool
+	bufferedBytes        int       // Received data bytes not yet taken by the connection handler
+	pendingBytes         int       // Part of bufferedBytes held in pendingPackets
+	gapSince             time.Time // When the current gap in front of pendingPackets opened
+	lastAdvertisedWindow int
+	ackTimer             *time.Timer // Pending delayed ack, nil if none
+	delivered            []*ParsedPacket
+	deliverSignal        chan struct{}
+	incoming             chan *ParsedPacket
+
+	aborted    bool // Set once the session is being torn down with an error close
+	peerClosed bool // Set once a close packet from the peer was received in order
+	closed     chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+// NewTunnelSession creates a session and starts its retransmit and delivery goroutines
+func NewTunnelSession(sessionID, role string, relayHandler *NostrRelayHandler, keyMgr *KeyManager, peerPubkey, direction, clientAddr string, config *SessionConfig, verbose bool) *TunnelSession {
+	publishQueue := NewPublishQueue(relayHandler, fmt.Sprintf("%s: Session %s", role, sessionID), verbose)
+	return newTunnelSession(sessionID, role, publishQueue, keyMgr, peerPubkey, direction, clientAddr, config, verbose)
+}
+
+// newTunnelSession creates a session that publishes through publishQueue
+func newTunnelSession(sessionID, role string, publishQueue *PublishQueue, keyMgr *KeyManager, peerPubkey, direction, clientAddr string, config *SessionConfig, verbose bool) *TunnelSession {
+	ts := &TunnelSession{
+		id:             sessionID,
+		role:           role,
+		publishQueue:   publishQueue,
+		keyMgr:         keyMgr,
+		peerPubkey:     peerPubkey,
+		direction:      direction,
+		clientAddr:     clientAddr,
+		padding:        config.PaddingBuckets.limit(maxRumorSize(config.MaxEventSize)),
+		config:         config,
+		verbose:        verbose,
+		nonce:          newRandomID(),
+		unacked:        make(map[uint64]*outboundPacket),
+		rto:            newRTOEstimator(),
+		ackedSignal:    make(chan struct{}, 1),
+		peerWindow:     initialPeerWindow,
+		sendFormat:     RumorFormatJSON,
+		windowSignal:   make(chan struct{}, 1),
+		pendingPackets: make(map[uint64]*ParsedPacket),
+		deliverSignal:  make(chan struct{}, 1),
+		incoming:       make(chan *ParsedPacket),
+		closed:         make(chan struct{}),
+		lastSent:       time.Now(),
+		lastReceived:   time.Now(),
+		nextCover:      time.Now().Add(config.CoverInterval),
+		peerTimeout:    config.PeerTimeout,
+	}
+
+	go ts.timerLoop()
+	go ts.deliverLoop()
+
+	return ts
+}
+
+// Incoming returns the in-order packet stream from the peer; it is closed when the session ends
+func (ts *TunnelSession) Incoming() <-chan *ParsedPacket {
+	return ts.incoming
+}
+
+// Done returns a channel that is closed when the session ends
+func (ts *TunnelSession) Done() <-chan struct{} {
+	return ts.closed
+}
+
+// Err returns the reason the session was aborted, or nil if it was closed normally
+func (ts *TunnelSession) Err() error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.err
+}
+
+// HandshakeTags returns the session parameters announced to the peer in open and open_ack packets
+func (ts *TunnelSession) HandshakeTags() nostr.Tags {
+	tags := nostr.Tags{
+		{"heartbeat_interval", strconv.FormatInt(ts.config.HeartbeatInterval.Milliseconds(), 10)},
+		{"format", string(RumorFormatBinary)},
+		{"nonce", ts.nonce},
+	}
+	if ts.config.Compression == CompressionDeflate {
+		tags = append(tags, nostr.Tag{"compression", string(CompressionDeflate)})
+	}
+	return tags
+}
+
+// Feed passes packets from a router queue to HandlePacket until the queue is closed or the session ends
+func (ts *TunnelSession) Feed(packets <-chan *ParsedPacket) {
+	for {
+		select {
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+			ts.HandlePacket(pkt)
+		case <-ts.closed:
+			return
+		}
+	}
+}
+
+// Send assigns the next sequence number to a packet, stores it in the retransmit buffer and publishes it.
+// Plain data is coalesced first (see coalesceData); any other packet flushes coalesced data
+// ahead of itself. Data packets block until the peer's advertised window has room for them.
+// data is copied, so the caller may reuse its buffer
+func (ts *TunnelSession) Send(packetType PacketType, data []byte, extraTags ...nostr.Tag) error {
+	ts.sendMutex.Lock()
+	defer ts.sendMutex.Unlock()
+
+	// After an abort only the error close may still go out, and after the peer closed nothing is wanted
+	if ts.sendEnded() {
+		ts.coalesced = nil
+		return ErrSessionClosed
+	}
+
+	if packetType == PacketTypeData && len(extraTags) == 0 {
+		return ts.coalesceData(data)
+	}
+	if err := ts.flushCoalescedData(); err != nil {
+		return err
+	}
+	return ts.sendFragmented(packetType, data, extraTags...)
+}
+
+// Flush sends any coalesced data right away
+func (ts *TunnelSession) Flush() error {
+	ts.sendMutex.Lock()
+	defer ts.sendMutex.Unlock()
+
+	if ts.sendEnded() {
+		ts.coalesced = nil
+		return ErrSessionClosed
+	}
+	return ts.flushCoalescedData()
+}
+
+// sendEnded reports whether the session no longer sends anything but an abort's close
+func (ts *TunnelSession) sendEnded() bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.aborted || ts.peerClosed
+}
+
+// coalesceTarget returns how much coalesced data is sent as one packet
+func (ts *TunnelSession) coalesceTarget() int {
+	if ts.config.CoalesceSize > 0 {
+		return ts.config.CoalesceSize
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return maxFragmentData(ts.config.MaxEventSize, ts.sendFormat)
+}
+
+// coalesceData collects data into full-sized packets, like Nagle's algorithm: data goes
+// out at once while nothing is in flight (or with a zero CoalesceDelay), full packets go out as
+// soon as they fill, and a partial packet waits at most CoalesceDelay for more data.
+// The caller holds sendMutex
+func (ts *TunnelSession) coalesceData(data []byte) error {
+	ts.coalesced = append(ts.coalesced, data...)
+
+	ts.mutex.Lock()
+	idle := ts.inflightBytes == 0
+	ts.mutex.Unlock()
+	if ts.config.CoalesceDelay <= 0 || idle {
+		return ts.flushCoalescedData()
+	}
+
+	target := ts.coalesceTarget()
+	for len(ts.coalesced) >= target {
+		chunk := ts.coalesced[:target]
+		ts.coalesced = ts.coalesced[target:]
+		if err := ts.sendFragmented(PacketTypeData, chunk); err != nil {
+			return err
+		}
+	}
+
+	if len(ts.coalesced) == 0 {
+		ts.coalesced = nil
+	} else if ts.coalesceTimer == nil {
+		ts.coalesceTimer = time.AfterFunc(ts.config.CoalesceDelay, ts.flushCoalesced)
+	}
+	return nil
+}
+
+// flushCoalesced sends data whose coalescing delay expired
+func (ts *TunnelSession) flushCoalesced() {
+	ts.sendMutex.Lock()
+	defer ts.sendMutex.Unlock()
+
+	ts.coalesceTimer = nil
+	if ts.sendEnded() {
+		ts.coalesced = nil
+		return
+	}
+	if err := ts.flushCoalescedData(); err != nil && err != ErrSessionClosed {
+		log.Printf("%s: Session %s - Failed to send coalesced data: %v", ts.role, ts.id, err)
+	}
+}
+
+// flushCoalescedData sends all coalesced data. The caller holds sendMutex
+func (ts *TunnelSession) flushCoalescedData() error {
+	if ts.coalesceTimer != nil {
+		ts.coalesceTimer.Stop()
+		ts.coalesceTimer = nil
+	}
+	if len(ts.coalesced) == 0 {
+		return nil
+	}
+
+	// Chunks never exceed the target, which the peer's decompression limit is checked against
+	data := ts.coalesced
+	ts.coalesced = nil
+	target := ts.coalesceTarget()
+	for len(data) > target {
+		if err := ts.sendFragmented(PacketTypeData, data[:target]); err != nil {
+			return err
+		}
+		data = data[target:]
+	}
+	return ts.sendFragmented(PacketTypeData, data)
+}
+
+// sendFragmented enqueues one packet, splitting data too large for one event into fragments
+// sent as consecutive packets. The caller holds sendMutex
+func (ts *TunnelSession) sendFragmented(packetType PacketType, data []byte, extraTags ...nostr.Tag) error {
+	ts.mutex.Lock()
+	maxData := maxFragmentData(ts.config.MaxEventSize, ts.sendFormat)
+	compress := ts.compress
+	ts.mutex.Unlock()
+
+	// The whole chunk is compressed before it is split, so fragments carry the encoding tag too
+	if packetType == PacketTypeData && compress {
+		if compressed, ok := compressChunk(data); ok {
+			data = compressed
+			extraTags = append(append(nostr.Tags{}, extraTags...), encodingTag(CompressionDeflate))
+		}
+	}
+
+	if packetType != PacketTypeData || len(data) <= maxData {
+		return ts.enqueue(packetType, data, extraTags...)
+	}
+
+	count := (len(data) + maxData - 1) / maxData
+	if ts.verbose {
+		log.Printf("%s: Session %s - Splitting %d bytes into %d fragments", ts.role, ts.id, len(data), count)
+	}
+	for i := 0; i < count; i++ {
+		end := (i + 1) * maxData
+		if end > len(data) {
+			end = len(data)
+		}
+		fragmentTags := append(append(nostr.Tags{}, extraTags...), fragmentTag(i, count))
+		if err := ts.enqueue(packetType, data[i*maxData:end], fragmentTags...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue waits for window space, then numbers, buffers and transmits a packet
+func (ts *TunnelSession) enqueue(packetType PacketType, data []byte, extraTags ...nostr.Tag) error {
+	if len(data) > 0 {
+		data = append([]byte(nil), data...)
+	}
+
+	ts.mutex.Lock()
+	for {
+		if ts.isClosed() {
+			ts.mutex.Unlock()
+			return ErrSessionClosed
+		}
+		if ts.canSendLocked(len(data)) {
+			break
+		}
+
+		ts.mutex.Unlock()
+		select {
+		case <-ts.windowSignal:
+		case <-ts.closed:
+		}
+		ts.mutex.Lock()
+	}
+
+	sequence := ts.nextSequence
+	ts.nextSequence++
+	if ts.config.Stats != nil {
+		ts.config.Stats.PacketsSent.Add(1)
+	}
+	out := &outboundPacket{
+		packetType: packetType,
+		data:       data,
+		extraTags:  extraTags,
+		sentAt:     time.Now(),
+	}
+	ts.unacked[sequence] = out
+	ts.inflightBytes += len(data)
+	ts.lastSent = out.sentAt
+	tags := append(ts.ackTagsLocked(), extraTags...)
+	ts.cancelDelayedAckLocked()
+	ts.mutex.Unlock()
+
+	ts.transmit(out, sequence, tags)
+	return nil
+}
+
+// canSendLocked reports whether a packet with the given payload size fits in the send window
+func (ts *TunnelSession) canSendLocked(size int) bool {
+	// Control packets carry no data and must never be held back
+	if size == 0 {
+		return true
+	}
+	if len(ts.unacked) >= maxInflightPackets {
+		return false
+	}
+	// With nothing in flight one packet is always allowed, which probes a closed window
+	return ts.inflightBytes == 0 || ts.inflightBytes+size <= ts.peerWindow
+}
+
+// transmit publishes one sequenced packet; failures are logged and left to retransmission
+func (ts *TunnelSession) transmit(out *outboundPacket, sequence uint64, tags nostr.Tags) {
+	packet := CreateDataPacket(out.data)
+
+	ts.mutex.Lock()
+	format := ts.sendFormat
+	ts.mutex.Unlock()
+
+	// The publish queue keeps packets in order per relay, so control packets need no special treatment
+	published := func(err error) {
+		if err != nil && err != ErrSessionClosed {
+			log.Printf("%s: Session %s - Failed to publish %s packet seq %d, will retransmit: %v", ts.role, ts.id, out.packetType, sequence, err)
+		}
+	}
+	clientAddr := ""
+	if out.packetType == PacketTypeOpen {
+		clientAddr = ts.clientAddr
+	}
+	if err := SendNostrPacket(ts.publishQueue, ts.keyMgr, packet, ts.peerPubkey, out.packetType, ts.id, sequence, ts.direction, "", 0, clientAddr, "", format, ts.padding, ts.verbose, published, tags...); err != nil {
+		log.Printf("%s: Session %s - Failed to send %s packet seq %d, will retransmit: %v", ts.role, ts.id, out.packetType, sequence, err)
+	}
+}
+
+// HandlePacket processes a packet received from the peer: acknowledgements are applied
+// to the retransmit buffer and sequenced packets are reordered and queued for delivery
+func (ts *TunnelSession) HandlePacket(pkt *ParsedPacket) {
+	ts.mutex.Lock()
+	if ts.isClosed() {
+		ts.mutex.Unlock()
+		return
+	}
+
+	// Only the peer's open can't know our nonce yet
+	if err := ts.checkNonceLocked(pkt); err != nil {
+		ts.mutex.Unlock()
+		if ts.verbose {
+			log.Printf("%s: Session %s - Dropping %s packet seq %d: %v", ts.role, ts.id, pkt.Type, pkt.Sequence, err)
+		}
+		return
+	}
+
+	ts.lastReceived = time.Now()
+	ts.peerSeen = true
+	if !ts.suspendedSince.IsZero() {
+		ts.resumeLocked()
+	}
+
+	if pkt.HasAck {
+		ts.processAckLocked(pkt.Ack, pkt.SelectiveAcks)
+	}
+	if pkt.HasWindow {
+		ts.peerWindow = pkt.Window
+		ts.signalWindowLocked()
+	}
+
+	if pkt.HeartbeatInterval > 0 {
+		ts.applyPeerHeartbeatLocked(pkt.HeartbeatInterval)
+	}
+	// Switch to the compact format once the peer's handshake says it can decode it
+	if pkt.Format == RumorFormatBinary && ts.sendFormat != RumorFormatBinary {
+		if ts.verbose {
+			log.Printf("%s: Session %s - Peer accepts binary rumors, switching format", ts.role, ts.id)
+		}
+		ts.sendFormat = RumorFormatBinary
+	}
+	if pkt.Compression == CompressionDeflate && ts.config.Compression == CompressionDeflate && !ts.compress {
+		if ts.verbose {
+			log.Printf("%s: Session %s - Peer accepts deflate, compressing data", ts.role, ts.id)
+		}
+		ts.compress = true
+	}
+
+	if pkt.Type == PacketTypeHeartbeat && ts.verbose {
+		log.Printf("%s: Session %s - Received heartbeat from peer", ts.role, ts.id)
+	}
+
+	// Acks and heartbeats are not sequenced, and once aborted only acknowledgements for our error close matter
+	if pkt.Type == PacketTypeAck || pkt.Type == PacketTypeHeartbeat || ts.aborted {
+		ts.mutex.Unlock()
+		return
+	}
+
+	ts.receivedAny = true
+	ackNow, failed := ts.receivePacketLocked(pkt)
+	if !ackNow {
+		ts.scheduleAckLocked()
+	}
+	ts.mutex.Unlock()
+
+	if failed != nil {
+		ts.Abort(failed)
+		return
+	}
+	if ackNow {
+		ts.sendAck()
+	}
+}
+
+// checkNonceLocked verifies that a packet echoes our nonce and learns the peer's nonce from its handshake
+func (ts *TunnelSession) checkNonceLocked(pkt *ParsedPacket) error {
+	if pkt.Type != PacketTypeOpen && pkt.PeerNonce != ts.nonce {
+		return fmt.Errorf("packet does not carry this session's nonce")
+	}
+	if pkt.Nonce != "" && pkt.Nonce != ts.peerNonce {
+		if ts.peerNonce != "" {
+			return fmt.Errorf("peer nonce changed")
+		}
+		ts.peerNonce = pkt.Nonce
+	}
+	return nil
+}
+
+// suspendLocked stops retransmitting until the peer is heard from again, which gives
+// it ResumeGrace to come back, e.g. after a relay outage, before the session is aborted
+func (ts *TunnelSession) suspendLocked(now time.Time, reason error) {
+	ts.suspendedSince = now
+	log.Printf("%s: Session %s - Suspending: %v; waiting up to %v for the peer to come back", ts.role, ts.id, reason, ts.config.ResumeGrace)
+}
+
+// resumeLocked leaves the suspended state after the peer was heard from again and
+// schedules every unacknowledged packet for immediate retransmission
+func (ts *TunnelSession) resumeLocked() {
+	log.Printf("%s: Session %s - Peer is back after %v, resuming with %d unacknowledged packet(s)", ts.role, ts.id, time.Since(ts.suspendedSince).Round(time.Second), len(ts.unacked))
+	ts.suspendedSince = time.Time{}
+
+	for _, out := range ts.unacked {
+		out.retries = 0
+		out.sentAt = time.Time{}
+	}
+	if len(ts.pendingPackets) > 0 {
+		ts.gapSince = time.Now()
+	}
+}
+
+// applyPeerHeartbeatLocked makes sure the peer timeout spans several of the peer's heartbeat
+// intervals, so a peer configured with a longer interval than ours is not declared dead
+func (ts *TunnelSession) applyPeerHeartbeatLocked(interval time.Duration) {
+	minTimeout := peerTimeoutHeartbeats * interval
+	if minTimeout <= ts.peerTimeout {
+		return
+	}
+	if ts.verbose {
+		log.Printf("%s: Session %s - Peer heartbeat interval is %v, raising peer timeout to %v", ts.role, ts.id, interval, minTimeout)
+	}
+	ts.peerTimeout = minTimeout
+}
+
+// receivePacketLocked reorders a sequenced packet and reports whether it should be acked
+// immediately. It returns an error if the session must be aborted, because buffering the
+// packet would exceed MaxBufferedBytes or the peer's fragments don't form a chunk
+func (ts *TunnelSession) receivePacketLocked(pkt *ParsedPacket) (bool, error) {
+	// Duplicates mean our ack was probably lost, so ack right away
+	if ts.received.seen(pkt.Sequence) {
+		if ts.config.Stats != nil {
+			ts.config.Stats.Duplicates.Add(1)
+		}
+		return true, nil
+	}
+
+	// Too far ahead to track: drop it and let the sender retransmit once the window moved
+	if !ts.received.inWindow(pkt.Sequence) {
+		if ts.verbose {
+			log.Printf("%s: Session %s - Dropping packet seq %d beyond receive window (expecting %d)", ts.role, ts.id, pkt.Sequence, ts.received.base)
+		}
+		return true, nil
+	}
+
+	// Check sequence order - if not the next expected, buffer it and report the gap
+	if pkt.Sequence != ts.received.base {
+		if ts.pendingBytes+len(pkt.Packet.Data) > ts.config.MaxBufferedBytes {
+			return false, fmt.Errorf("more than %d bytes buffered out of order", ts.config.MaxBufferedBytes)
+		}
+		if len(ts.pendingPackets) == 0 {
+			ts.gapSince = time.Now()
+		}
+		ts.received.mark(pkt.Sequence)
+		ts.pendingPackets[pkt.Sequence] = pkt
+		ts.pendingBytes += len(pkt.Packet.Data)
+		ts.bufferedBytes += len(pkt.Packet.Data)
+		if ts.verbose {
+			log.Printf("%s: Session %s - Buffering out-of-order packet seq %d (expecting %d)", ts.role, ts.id, pkt.Sequence, ts.received.base)
+		}
+		return true, nil
+	}
+
+	// Process this packet and any consecutive buffered packets
+	ts.received.mark(pkt.Sequence)
+	ts.bufferedBytes += len(pkt.Packet.Data)
+	packetsToDeliver := []*ParsedPacket{pkt}
+	next := ts.received.advance()
+	for seq := pkt.Sequence + 1; seq < next; seq++ {
+		bufferedPacket := ts.pendingPackets[seq]
+		packetsToDeliver = append(packetsToDeliver, bufferedPacket)
+		delete(ts.pendingPackets, seq)
+		ts.pendingBytes -= len(bufferedPacket.Packet.Data)
+	}
+
+	// The gap closed; if packets are still pending, a new gap starts now
+	if len(ts.pendingPackets) > 0 {
+		ts.gapSince = time.Now()
+	}
+
+	ackNow := false
+	for _, p := range packetsToDeliver {
+		if p.Type != PacketTypeData {
+			// The peer tears down after control packets, so don't delay their ack
+			ackNow = true
+		}
+		if p.Type == PacketTypeClose {
+			ts.peerClosed = true
+			ts.dropUnackedLocked()
+		}
+
+		// Fragments are held back until their chunk is complete
+		whole, err := ts.reassembly.add(p)
+		if err != nil {
+			return false, err
+		}
+		if whole != nil {
+			ts.delivered = append(ts.delivered, whole)
+		}
+	}
+
+	select {
+	case ts.deliverSignal <- struct{}{}:
+	default:
+	}
+
+	return ackNow, nil
+}
+
+// processAckLocked removes acknowledged packets from the retransmit buffer and samples the RTT
+func (ts *TunnelSession) processAckLocked(cumulative uint64, selective []uint64) {
+	now := time.Now()
+	removed := false
+
+	acknowledge := func(seq uint64) {
+		out, exists := ts.unacked[seq]
+		if !exists {
+			return
+		}
+		// Karn's algorithm: only packets sent once give an unambiguous RTT sample
+		if out.retries == 0 {
+			ts.rto.sample(now.Sub(out.sentAt))
+		}
+		delete(ts.unacked, seq)
+		ts.inflightBytes -= len(out.data)
+		removed = true
+	}
+
+	for seq := range ts.unacked {
+		if seq < cumulative {
+			acknowledge(seq)
+		}
+	}
+	for _, seq := range selective {
+		acknowledge(seq)
+	}
+
+	if removed {
+		select {
+		case ts.ackedSignal <- struct{}{}:
+		default:
+		}
+		ts.signalWindowLocked()
+	}
+}
+
+// dropUnackedLocked empties the retransmit buffer after the peer closed the session,
+// since nothing still in flight will be acknowledged and Close need not wait for it
+func (ts *TunnelSession) dropUnackedLocked() {
+	if len(ts.unacked) == 0 {
+		return
+	}
+	ts.unacked = make(map[uint64]*outboundPacket)
+	ts.inflightBytes = 0
+	select {
+	case ts.ackedSignal <- struct{}{}:
+	default:
+	}
+	ts.signalWindowLocked()
+}
+
+// signalWindowLocked wakes a Send waiting for window space
+func (ts *TunnelSession) signalWindowLocked() {
+	select {
+	case ts.windowSignal <- struct{}{}:
+	default:
+	}
+}
+
+// advertisedWindowLocked returns the receive credit we currently grant the peer
+func (ts *TunnelSession) advertisedWindowLocked() int {
+	window := receiveWindowSize - ts.bufferedBytes
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// ackTagsLocked returns the tags describing what we have received, or nil before the first packet.
+// It records the window as advertised, so it must only be called for tags that are sent
+func (ts *TunnelSession) ackTagsLocked() nostr.Tags {
+	if !ts.receivedAny {
+		return nil
+	}
+
+	ts.lastAdvertisedWindow = ts.advertisedWindowLocked()
+	tags := nostr.Tags{
+		{"ack", strconv.FormatUint(ts.received.base, 10)},
+		{"window", strconv.Itoa(ts.lastAdvertisedWindow)},
+		{"peer_nonce", ts.peerNonce},
+	}
+
+	if len(ts.pendingPackets) > 0 {
+		sacks := make([]uint64, 0, len(ts.pendingPackets))
+		for seq := range ts.pendingPackets {
+			sacks = append(sacks, seq)
+		}
+		sort.Slice(sacks, func(i, j int) bool { return sacks[i] < sacks[j] })
+		if len(sacks) > maxSelectiveAcks {
+			sacks = sacks[:maxSelectiveAcks]
+		}
+
+		sackStrs := make([]string, len(sacks))
+		for i, seq := range sacks {
+			sackStrs[i] = strconv.FormatUint(seq, 10)
+		}
+		tags = append(tags, nostr.Tag{"sack", strings.Join(sackStrs, ",")})
+	}
+
+	return tags
+}
+
+// cancelDelayedAckLocked stops the delayed ack timer; called when a packet carrying our ack
+// tags is about to be sent, so a separate ack is no longer needed
+func (ts *TunnelSession) cancelDelayedAckLocked() {
+	if ts.ackTimer != nil {
+		ts.ackTimer.Stop()
+		ts.ackTimer = nil
+	}
+}
+
+// scheduleAckLocked arms the delayed ack timer if it isn't already running
+func (ts *TunnelSession) scheduleAckLocked() {
+	if ts.ackTimer != nil {
+		return
+	}
+	ts.ackTimer = time.AfterFunc(ackDelay, ts.sendAck)
+}
+
+// sendAck publishes a standalone ack packet
+func (ts *TunnelSession) sendAck() {
+	ts.sendUnsequenced(PacketTypeAck)
+}
+
+// sendHeartbeat publishes a heartbeat, which also refreshes the peer's view of our acks and window
+func (ts *TunnelSession) sendHeartbeat() {
+	if ts.verbose {
+		log.Printf("%s: Session %s - Sending heartbeat", ts.role, ts.id)
+	}
+	ts.sendUnsequenced(PacketTypeHeartbeat)
+}
+
+// sendUnsequenced publishes an ack or heartbeat; these are not sequenced and never retransmitted
+func (ts *TunnelSession) sendUnsequenced(packetType PacketType) {
+	ts.mutex.Lock()
+	if ts.isClosed() {
+		ts.mutex.Unlock()
+		return
+	}
+	tags := ts.ackTagsLocked()
+	if tags == nil && packetType == PacketTypeAck {
+		ts.mutex.Unlock()
+		return
+	}
+	ts.cancelDelayedAckLocked()
+	ts.lastSent = time.Now()
+	format := ts.sendFormat
+	ts.mutex.Unlock()
+
+	published := func(err error) {
+		if err != nil && err != ErrSessionClosed && ts.verbose {
+			log.Printf("%s: Session %s - Failed to publish %s: %v", ts.role, ts.id, packetType, err)
+		}
+	}
+	if err := SendNostrPacket(ts.publishQueue, ts.keyMgr, CreateEmptyPacket(), ts.peerPubkey, packetType, ts.id, 0, ts.direction, "", 0, "", "", format, ts.padding, ts.verbose, published, tags...); err != nil {
+		log.Printf("%s: Session %s - Failed to send %s: %v", ts.role, ts.id, packetType, err)
+	}
+}
+
+// sendCover publishes a dummy packet of random size. It does not count as activity, so it
+// neither delays heartbeats nor tells the peer anything
+func (ts *TunnelSession) sendCover() {
+	ts.mutex.Lock()
+	if ts.isClosed() {
+		ts.mutex.Unlock()
+		return
+	}
+	format := ts.sendFormat
+	ts.mutex.Unlock()
+
+	published := func(err error) {
+		if err != nil && err != ErrSessionClosed && ts.verbose {
+			log.Printf("%s: Session %s - Failed to publish cover packet: %v", ts.role, ts.id, err)
+		}
+	}
+	packet := newCoverPacket(maxFragmentData(ts.config.MaxEventSize, format))
+	if err := SendNostrPacket(ts.publishQueue, ts.keyMgr, packet, ts.peerPubkey, PacketTypeCover, ts.id, 0, ts.direction, "", 0, "", "", format, ts.padding, ts.verbose, published); err != nil {
+		log.Printf("%s: Session %s - Failed to send cover packet: %v", ts.role, ts.id, err)
+	}
+}
+
+// timerLoop resends packets whose retransmission timeout expired, sends heartbeats
+// on idle sessions and cover traffic, suspends the session when the peer stops responding and enforces
+// the gap and resume timeouts until the session ends
+func (ts *TunnelSession) timerLoop() {
+	ticker := time.NewTicker(retransmitTick)
+	defer ticker.Stop()
+
+	type retransmission struct {
+		out      *outboundPacket
+		sequence uint64
+		tags     nostr.Tags
+	}
+
+	for {
+		select {
+		case <-ts.closed:
+			return
+		case now := <-ticker.C:
+			var due []retransmission
+			var stalled error
+
+			ts.mutex.Lock()
+			suspended := !ts.suspendedSince.IsZero()
+			// While suspended nothing is retransmitted; heartbeats probe for the peer instead
+			if !suspended {
+				for seq, out := range ts.unacked {
+					if now.Sub(out.sentAt) < ts.rto.timeout(out.retries) {
+						continue
+					}
+					if out.retries >= maxRetransmits {
+						stalled = fmt.Errorf("packet seq %d not acknowledged after %d retransmissions", seq, out.retries)
+						break
+					}
+					out.retries++
+					out.sentAt = now
+					ts.lastSent = now
+					due = append(due, retransmission{out, seq, nil})
+				}
+			}
+			if stalled == nil && !suspended && !ts.aborted && now.Sub(ts.lastReceived) >= ts.peerTimeout {
+				stalled = fmt.Errorf("peer silent for %v", now.Sub(ts.lastReceived).Round(time.Second))
+			}
+			// A peer that never answered, e.g. a server that is down, is not waited for
+			if stalled != nil && !ts.aborted && ts.config.ResumeGrace > 0 && ts.peerSeen {
+				ts.suspendLocked(now, stalled)
+				stalled = nil
+				suspended = true
+			}
+			failed := stalled
+			if failed == nil && suspended && now.Sub(ts.suspendedSince) >= ts.config.ResumeGrace {
+				failed = fmt.Errorf("peer unreachable for %v, giving up", now.Sub(ts.suspendedSince).Round(time.Second))
+			}
+			// Missing packets cannot arrive while the peer is unreachable, so the gap timeout waits too
+			if failed == nil && !suspended && !ts.aborted && len(ts.pendingPackets) > 0 && now.Sub(ts.gapSince) >= ts.config.GapTimeout {
+				failed = fmt.Errorf("packet seq %d missing for %v with %d packet(s) buffered", ts.received.base, ts.config.GapTimeout, len(ts.pendingPackets))
+			}
+			heartbeatDue := !ts.aborted && now.Sub(ts.lastSent) >= ts.config.HeartbeatInterval
+			// Cover traffic keeps a steady rate whatever the session is doing, but pauses while the peer is away
+			coverDue := ts.config.CoverInterval > 0 && !suspended && !ts.aborted && !now.Before(ts.nextCover)
+			if coverDue {
+				ts.nextCover = now.Add(ts.config.CoverInterval)
+			}
+			// Ack tags are only built when they go out, since building them records the advertised window
+			if failed == nil && len(due) > 0 {
+				ackTags := ts.ackTagsLocked()
+				for i := range due {
+					due[i].tags = append(append(nostr.Tags{}, ackTags...), due[i].out.extraTags...)
+				}
+				ts.cancelDelayedAckLocked()
+			}
+			aborted := ts.aborted
+			ts.mutex.Unlock()
+
+			if failed != nil {
+				if aborted {
+					// Not even the error close got through, or the peer never came back; nothing is left to wait for
+					ts.shutdown()
+					return
+				}
+				ts.Abort(failed)
+				continue
+			}
+
+			if ts.config.Stats != nil {
+				ts.config.Stats.Retransmissions.Add(uint64(len(due)))
+			}
+			for _, r := range due {
+				if ts.verbose {
+					log.Printf("%s: Session %s - Retransmitting %s packet seq %d (attempt %d)", ts.role, ts.id, r.out.packetType, r.sequence, r.out.retries)
+				}
+				ts.transmit(r.out, r.sequence, r.tags)
+			}
+
+			if heartbeatDue {
+				ts.sendHeartbeat()
+			}
+			if coverDue {
+				ts.sendCover()
+			}
+		}
+	}
+}
+
+// deliverLoop hands reordered packets to the connection handler through the incoming channel
+func (ts *TunnelSession) deliverLoop() {
+	defer close(ts.incoming)
+
+	for {
+		ts.mutex.Lock()
+		if ts.aborted {
+			ts.mutex.Unlock()
+			return
+		}
+		if len(ts.delivered) == 0 {
+			ts.mutex.Unlock()
+			select {
+			case <-ts.deliverSignal:
+				continue
+			case <-ts.closed:
+				return
+			}
+		}
+		pkt := ts.delivered[0]
+		ts.delivered[0] = nil
+		ts.delivered = ts.delivered[1:]
+		ts.mutex.Unlock()
+
+		// Buffer accounting and flow control count the bytes as sent over the wire
+		wireSize := len(pkt.Packet.Data)
+		if pkt.Encoding != "" {
+			data, err := decompressChunk(pkt.Encoding, pkt.Packet.Data)
+			if err != nil {
+				ts.Abort(err)
+				continue
+			}
+			decoded := *pkt
+			decoded.Packet = &Packet{Data: data}
+			pkt = &decoded
+		}
+
+		select {
+		case ts.incoming <- pkt:
+		case <-ts.closed:
+			return
+		}
+
+		// The handler took the data, so its buffer space is free again; tell the
+		// peer once the window has grown enough since our last advertisement
+		ts.mutex.Lock()
+		ts.bufferedBytes -= wireSize
+		windowUpdate := ts.advertisedWindowLocked()-ts.lastAdvertisedWindow >= receiveWindowSize/4
+		ts.mutex.Unlock()
+
+		if windowUpdate {
+			ts.sendAck()
+		}
+	}
+}
+
+// Close ends the session after waiting, for at most sessionLingerTime, until the peer
+// has acknowledged everything we sent
+func (ts *TunnelSession) Close() {
+	if err := ts.Flush(); err != nil && err != ErrSessionClosed {
+		log.Printf("%s: Session %s - Failed to send coalesced data: %v", ts.role, ts.id, err)
+	}
+
+	deadline := time.NewTimer(sessionLingerTime)
+	defer deadline.Stop()
+
+drain:
+	for {
+		ts.mutex.Lock()
+		outstanding := len(ts.unacked)
+		ts.mutex.Unlock()
+
+		if outstanding == 0 {
+			break
+		}
+
+		select {
+		case <-ts.ackedSignal:
+		case <-ts.closed:
+			return
+		case <-deadline.C:
+			if ts.verbose {
+				log.Printf("%s: Session %s - Closing with %d unacknowledged packet(s)", ts.role, ts.id, outstanding)
+			}
+			break drain
+		}
+	}
+
+	ts.shutdown()
+}
+
+// Abort tears the session down after an unrecoverable error: delivery to the handler
+// stops, and the peer is sent a close packet carrying the error so it releases its side too.
+// The handler still calls Close, which gives that close packet time to be acknowledged
+func (ts *TunnelSession) Abort(err error) {
+	ts.mutex.Lock()
+	if ts.aborted || ts.isClosed() {
+		ts.mutex.Unlock()
+		return
+	}
+	ts.aborted = true
+	ts.err = err
+	ts.delivered = nil
+	ts.mutex.Unlock()
+
+	log.Printf("%s: Session %s - Aborting: %v", ts.role, ts.id, err)
+
+	// Wake the delivery loop so it closes the incoming channel
+	select {
+	case ts.deliverSignal <- struct{}{}:
+	default:
+	}
+
+	if err := ts.enqueue(PacketTypeClose, nil, errorTag(err)); err != nil && err != ErrSessionClosed {
+		log.Printf("%s: Session %s - Failed to send error close packet: %v", ts.role, ts.id, err)
+	}
+}
+
+func (ts *TunnelSession) shutdown() {
+	ts.closeOnce.Do(func() {
+		ts.publishQueue.Close()
+		ts.mutex.Lock()
+		ts.cancelDelayedAckLocked()
+		ts.mutex.Unlock()
+		close(ts.closed)
+	})
+}
+
+// isClosed reports whether the session has ended
+func (ts *TunnelSession) isClosed() bool {
+	select {
+	case <-ts.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// newRandomID returns a random 128-bit value in hex, used for session IDs and nonces
+func newRandomID() string {
+	id := make([]byte, 16)
+	rand.Read(id) // Never returns an error as of Go 1.24
+	return hex.EncodeToString(id)
+}
+
+// closeWrite shuts down the sending half of a connection after the peer sent a fin,
+// falling back to a full close for connections that cannot be half-closed
+func closeWrite(conn net.Conn) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// resetConn closes a connection with a TCP reset instead of a FIN, so the local
+// application sees a tunnel failure as a reset rather than a clean end of stream
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
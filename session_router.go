@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SessionRouter unwraps each incoming gift wrap exactly once and dispatches the
+// resulting packet to the queue of the session it belongs to, so several local
+// connections can share one relay subscription without stealing each other's events.
+// Gift wraps are decrypted by a pool of workers, but dispatched in the order they arrived
+type SessionRouter struct {
+	relayHandler *NostrRelayHandler
+	keyMgr       *KeyManager
+	myPubkey     string
+	direction    string // Only packets travelling in this direction are routed
+	verbose      bool
+
+	sessionsMutex sync.RWMutex
+	sessions      map[string]*routedSession // sessionID -> packet queue
+
+	onOpen func(*ParsedPacket) // Called for opens of unknown sessions, before they are dispatched
+}
+
+// routedSession is a registered session and the only pubkey allowed to send it packets
+type routedSession struct {
+	queue      chan *ParsedPacket
+	peerPubkey string
+}
+
+// decryptJob is one gift wrap handed to a decryption worker; the result is nil if unwrapping failed
+type decryptJob struct {
+	event  *nostr.Event
+	result chan *ParsedPacket
+}
+
+// decryptQueueSize is how many gift wraps may be decrypting or waiting for their turn to be dispatched
+const decryptQueueSize = 256
+
+// sessionQueueSize is the number of packets buffered per session before the router starts dropping.
+// Flow control keeps at most maxInflightPackets data packets in flight, so only bursts of
+// retransmitted duplicates can overflow it, and those are recovered by retransmission
+const sessionQueueSize = 4 * maxInflightPackets
+
+// NewSessionRouter creates a router for packets addressed to myPubkey and travelling in the given direction
+func NewSessionRouter(relayHandler *NostrRelayHandler, keyMgr *KeyManager, myPubkey, direction string, verbose bool) *SessionRouter {
+	return &SessionRouter{
+		relayHandler: relayHandler,
+		keyMgr:       keyMgr,
+		myPubkey:     myPubkey,
+		direction:    direction,
+		verbose:      verbose,
+		sessions:     make(map[string]*routedSession),
+	}
+}
+
+// OnOpen sets the handler for open packets of sessions that are not registered yet.
+// It runs on the dispatching goroutine and must Register the session for it to receive the
+// open; an open that is left unregistered is dropped
+func (sr *SessionRouter) OnOpen(handler func(*ParsedPacket)) {
+	sr.onOpen = handler
+}
+
+// Register creates the packet queue for a session whose packets must be signed by
+// peerPubkey; it must be called before the session's first packet is sent so that no
+// reply can arrive unrouted
+func (sr *SessionRouter) Register(sessionID, peerPubkey string) <-chan *ParsedPacket {
+	sr.sessionsMutex.Lock()
+	defer sr.sessionsMutex.Unlock()
+
+	queue := make(chan *ParsedPacket, sessionQueueSize)
+	sr.sessions[sessionID] = &routedSession{queue: queue, peerPubkey: peerPubkey}
+	return queue
+}
+
+// Unregister removes a session and closes its packet queue
+func (sr *SessionRouter) Unregister(sessionID string) {
+	sr.sessionsMutex.Lock()
+	defer sr.sessionsMutex.Unlock()
+
+	if session, exists := sr.sessions[sessionID]; exists {
+		close(session.queue)
+		delete(sr.sessions, sessionID)
+	}
+}
+
+// Run reads events from the relay handler until its channel is closed, decrypting them in
+// parallel and dispatching each one in arrival order
+func (sr *SessionRouter) Run() {
+	jobs := make(chan decryptJob, decryptQueueSize)
+	ordered := make(chan chan *ParsedPacket, decryptQueueSize)
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go sr.decryptWorker(jobs)
+	}
+
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+
+		for event := range sr.relayHandler.GetEventChannel() {
+			// Check if this event is for us
+			if !IsEventForMe(event, sr.myPubkey) {
+				if sr.verbose {
+					log.Printf("Router: Event %s not for us (our pubkey: %s)", event.ID, sr.myPubkey)
+				}
+				continue
+			}
+
+			result := make(chan *ParsedPacket, 1)
+			ordered <- result
+			jobs <- decryptJob{event: event, result: result}
+		}
+	}()
+
+	for result := range ordered {
+		parsedPacket := <-result
+		// Cover traffic only exists to be seen on the relays and is dropped without a trace
+		if parsedPacket == nil || parsedPacket.Direction != sr.direction || parsedPacket.Type == PacketTypeCover {
+			continue
+		}
+
+		if parsedPacket.Type == PacketTypeOpen && sr.onOpen != nil && !sr.registered(parsedPacket.SessionID) {
+			sr.onOpen(parsedPacket)
+		}
+		sr.dispatch(parsedPacket)
+	}
+}
+
+// decryptWorker unwraps gift wraps until the job queue is closed
+func (sr *SessionRouter) decryptWorker(jobs <-chan decryptJob) {
+	for job := range jobs {
+		// Version compatibility is checked in UnwrapEphemeralGiftWrap
+		parsedPacket, err := sr.keyMgr.UnwrapEphemeralGiftWrap(job.event)
+		if err != nil {
+			if sr.verbose {
+				log.Printf("Router: Error unwrapping encrypted event %s: %v", job.event.ID, err)
+			}
+		}
+		job.result <- parsedPacket
+	}
+}
+
+// registered reports whether a session has a packet queue
+func (sr *SessionRouter) registered(sessionID string) bool {
+	sr.sessionsMutex.RLock()
+	defer sr.sessionsMutex.RUnlock()
+
+	_, exists := sr.sessions[sessionID]
+	return exists
+}
+
+// dispatch hands a packet to its session queue without blocking the other sessions
+func (sr *SessionRouter) dispatch(parsedPacket *ParsedPacket) {
+	// The read lock is held while sending so Unregister cannot close the queue underneath us
+	sr.sessionsMutex.RLock()
+	defer sr.sessionsMutex.RUnlock()
+
+	session, exists := sr.sessions[parsedPacket.SessionID]
+	if !exists {
+		if sr.verbose {
+			log.Printf("Router: Received packet for unknown session %s", parsedPacket.SessionID)
+		}
+		return
+	}
+	if parsedPacket.ClientPubkey != session.peerPubkey {
+		if sr.verbose {
+			log.Printf("Router: Dropping packet for session %s from %s, the session belongs to %s", parsedPacket.SessionID, parsedPacket.ClientPubkey, session.peerPubkey)
+		}
+		return
+	}
+
+	select {
+	case session.queue <- parsedPacket:
+	default:
+		if sr.verbose {
+			log.Printf("Router: Session %s packet queue full, dropping packet seq %d", parsedPacket.SessionID, parsedPacket.Sequence)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestRouter starts a client-side router fed by events pushed into the returned channel
+func newTestRouter(t *testing.T, keys *KeyManager) (*SessionRouter, chan *nostr.Event) {
+	t.Helper()
+	events := make(chan *nostr.Event, 16)
+	relayHandler := &NostrRelayHandler{eventChan: events}
+	router := NewSessionRouter(relayHandler, keys, keys.GetKeys().PublicKey, "server_to_client", false)
+	go router.Run()
+	t.Cleanup(func() { close(events) })
+	return router, events
+}
+
+// wrapFor gift wraps a server packet of a session for the recipient
+func wrapFor(t *testing.T, sender *KeyManager, recipient *KeyManager, sessionID string, sequence uint64) *nostr.Event {
+	t.Helper()
+	event, err := sender.CreateEphemeralGiftWrappedEvent(NewPacket([]byte(sessionID)), recipient.GetKeys().PublicKey, PacketTypeData, sessionID, sequence, "server_to_client", "", 0, "", "", RumorFormatJSON, nil)
+	if err != nil {
+		t.Fatalf("CreateEphemeralGiftWrappedEvent: %v", err)
+	}
+	return event
+}
+
+// receive returns the next packet of a session queue, or nil if none arrives in time
+func receive(queue <-chan *ParsedPacket) *ParsedPacket {
+	select {
+	case pkt := <-queue:
+		return pkt
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestRouterSeparatesSessions(t *testing.T) {
+	client := newTestKeyManager(t)
+	server := newTestKeyManager(t)
+	router, events := newTestRouter(t, client)
+	serverPubkey := server.GetKeys().PublicKey
+
+	queues := map[string]<-chan *ParsedPacket{
+		"session-a": router.Register("session-a", serverPubkey),
+		"session-b": router.Register("session-b", serverPubkey),
+	}
+	// Both sessions share the one event channel, interleaved
+	for sequence := uint64(0); sequence < 3; sequence++ {
+		events <- wrapFor(t, server, client, "session-a", sequence)
+		events <- wrapFor(t, server, client, "session-b", sequence)
+	}
+
+	for sessionID, queue := range queues {
+		for sequence := uint64(0); sequence < 3; sequence++ {
+			pkt := receive(queue)
+			if pkt == nil {
+				t.Fatalf("%s received no packet seq %d", sessionID, sequence)
+			}
+			if pkt.SessionID != sessionID || pkt.Sequence != sequence {
+				t.Errorf("%s received %s seq %d, want seq %d", sessionID, pkt.SessionID, pkt.Sequence, sequence)
+			}
+		}
+		if pkt := receive(queue); pkt != nil {
+			t.Errorf("%s received an extra packet of %s", sessionID, pkt.SessionID)
+		}
+	}
+}
+
+func TestRouterDropsPacketsFromOtherKeys(t *testing.T) {
+	client := newTestKeyManager(t)
+	server := newTestKeyManager(t)
+	intruder := newTestKeyManager(t)
+	router, events := newTestRouter(t, client)
+
+	queue := router.Register("session", server.GetKeys().PublicKey)
+	// The intruder knows the session ID but signs with its own key
+	events <- wrapFor(t, intruder, client, "session", 0)
+	if pkt := receive(queue); pkt != nil {
+		t.Fatalf("session received seq %d signed by %s", pkt.Sequence, pkt.ClientPubkey)
+	}
+
+	// The session's own peer still gets through
+	events <- wrapFor(t, server, client, "session", 0)
+	if pkt := receive(queue); pkt == nil || pkt.ClientPubkey != server.GetKeys().PublicKey {
+		t.Fatalf("session received %v, want the server's packet", pkt)
+	}
+}
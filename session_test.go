@@ -0,0 +1,278 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testPair is a client and a server session connected through in-memory publish queues.
+// Every event is unwrapped by the peer's key manager, so the tests see the packets exactly
+// as the peer would
+type testPair struct {
+	client, server *TunnelSession
+
+	mutex sync.Mutex
+	sent  map[*TunnelSession][]sentPacket // Packets each session published, in order
+	drop  func(from *TunnelSession, pkt *ParsedPacket) bool
+}
+
+// sentPacket is a published packet and when it was published
+type sentPacket struct {
+	pkt *ParsedPacket
+	at  time.Time
+}
+
+func newTestKeyManager(t *testing.T) *KeyManager {
+	t.Helper()
+	km := NewKeyManager("", 16, 1, defaultReplayWindow)
+	if err := km.GenerateKeys(); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	return km
+}
+
+// newTestPair creates both sessions and runs the open handshake
+func newTestPair(t *testing.T, config *SessionConfig) *testPair {
+	t.Helper()
+	clientKeys := newTestKeyManager(t)
+	serverKeys := newTestKeyManager(t)
+	pair := &testPair{sent: make(map[*TunnelSession][]sentPacket)}
+
+	// Sessions are assigned before anything is sent, so the closures below always see both
+	var client, server *TunnelSession
+	connect := func(from **TunnelSession, to **TunnelSession, peerKeys *KeyManager) publishFunc {
+		return func(url string, event *nostr.Event) <-chan error {
+			pkt, err := peerKeys.UnwrapEphemeralGiftWrap(event)
+			if err != nil {
+				// Dropped like the router drops it
+				t.Logf("unwrap: %v", err)
+				return answered(nil)
+			}
+			pair.mutex.Lock()
+			pair.sent[*from] = append(pair.sent[*from], sentPacket{pkt, time.Now()})
+			drop := pair.drop != nil && pair.drop(*from, pkt)
+			pair.mutex.Unlock()
+			if !drop {
+				(*to).HandlePacket(pkt)
+			}
+			return answered(nil)
+		}
+	}
+
+	clientQueue := newPublishQueue([]string{"mem://server"}, connect(&client, &server, serverKeys), "Test: Client", false)
+	serverQueue := newPublishQueue([]string{"mem://client"}, connect(&server, &client, clientKeys), "Test: Server", false)
+	client = newTunnelSession("test", "Client", clientQueue, clientKeys, serverKeys.GetKeys().PublicKey, "client_to_server", "", config, false)
+	server = newTunnelSession("test", "Server", serverQueue, serverKeys, clientKeys.GetKeys().PublicKey, "server_to_client", "", config, false)
+	pair.client, pair.server = client, server
+	t.Cleanup(func() {
+		client.shutdown()
+		server.shutdown()
+	})
+
+	if err := client.Send(PacketTypeOpen, nil, client.HandshakeTags()...); err != nil {
+		t.Fatalf("send open: %v", err)
+	}
+	expectIncoming(t, server, PacketTypeOpen)
+	acceptTags := append(server.HandshakeTags(), nostr.Tag{"status", "accept"})
+	if err := server.Send(PacketTypeOpenAck, nil, acceptTags...); err != nil {
+		t.Fatalf("send open_ack: %v", err)
+	}
+	if err := awaitOpenAck(client, 2*time.Second); err != nil {
+		t.Fatalf("awaitOpenAck: %v", err)
+	}
+	return pair
+}
+
+// expectIncoming waits for the next delivered packet of a session and checks its type
+func expectIncoming(t *testing.T, ts *TunnelSession, packetType PacketType) *ParsedPacket {
+	t.Helper()
+	select {
+	case pkt := <-ts.Incoming():
+		if pkt.Type != packetType {
+			t.Fatalf("%s received %s, want %s", ts.role, pkt.Type, packetType)
+		}
+		return pkt
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s received no %s", ts.role, packetType)
+		return nil
+	}
+}
+
+// waitSent waits until a session published a packet matching match and returns it
+func (tp *testPair) waitSent(from *TunnelSession, timeout time.Duration, match func(*ParsedPacket) bool) (sentPacket, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		tp.mutex.Lock()
+		for _, sent := range tp.sent[from] {
+			if match(sent.pkt) {
+				tp.mutex.Unlock()
+				return sent, true
+			}
+		}
+		tp.mutex.Unlock()
+		if time.Now().After(deadline) {
+			return sentPacket{}, false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// count returns how many packets a session published that match match
+func (tp *testPair) count(from *TunnelSession, match func(*ParsedPacket) bool) int {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	n := 0
+	for _, sent := range tp.sent[from] {
+		if match(sent.pkt) {
+			n++
+		}
+	}
+	return n
+}
+
+// lastSent returns the last packet a session published that matches match, or nil
+func (tp *testPair) lastSent(from *TunnelSession, match func(*ParsedPacket) bool) *ParsedPacket {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	sent := tp.sent[from]
+	for i := len(sent) - 1; i >= 0; i-- {
+		if match(sent[i].pkt) {
+			return sent[i].pkt
+		}
+	}
+	return nil
+}
+
+func TestDelayedAckIsSent(t *testing.T) {
+	pair := newTestPair(t, DefaultSessionConfig())
+
+	sentAt := time.Now()
+	if err := pair.client.Send(PacketTypeData, []byte("hello")); err != nil {
+		t.Fatalf("send data: %v", err)
+	}
+	data := expectIncoming(t, pair.server, PacketTypeData)
+
+	// The server has nothing to send, so only a standalone delayed ack can acknowledge the data
+	ack, ok := pair.waitSent(pair.server, time.Second, func(pkt *ParsedPacket) bool {
+		return pkt.Type == PacketTypeAck && pkt.HasAck && pkt.Ack > data.Sequence
+	})
+	if !ok {
+		t.Fatalf("server sent no ack for seq %d", data.Sequence)
+	}
+	if elapsed := ack.at.Sub(sentAt); elapsed > ackDelay+2*retransmitTick {
+		t.Errorf("ack took %v, want about %v", elapsed, ackDelay)
+	}
+	if n := pair.count(pair.client, func(pkt *ParsedPacket) bool { return pkt.Type == PacketTypeData && pkt.Sequence == data.Sequence }); n != 1 {
+		t.Errorf("data packet sent %d times, want 1", n)
+	}
+}
+
+func TestAdvertisedWindowMatchesSentAck(t *testing.T) {
+	pair := newTestPair(t, DefaultSessionConfig())
+
+	if err := pair.client.Send(PacketTypeData, make([]byte, 1000)); err != nil {
+		t.Fatalf("send data: %v", err)
+	}
+	sent, ok := pair.waitSent(pair.client, time.Second, func(pkt *ParsedPacket) bool { return pkt.Type == PacketTypeData })
+	if !ok {
+		t.Fatal("client sent no data")
+	}
+	ack, ok := pair.waitSent(pair.server, time.Second, func(pkt *ParsedPacket) bool {
+		return pkt.Type == PacketTypeAck && pkt.Ack > sent.pkt.Sequence
+	})
+	if !ok {
+		t.Fatalf("server sent no ack for seq %d", sent.pkt.Sequence)
+	}
+
+	// Reading the data after the ack went out grows the window without advertising it.
+	// Retransmit ticks that send nothing must not pretend the peer saw the new window
+	expectIncoming(t, pair.server, PacketTypeData)
+	time.Sleep(3 * retransmitTick)
+	pair.server.mutex.Lock()
+	advertised := pair.server.lastAdvertisedWindow
+	pair.server.mutex.Unlock()
+	if last := pair.lastSent(pair.server, func(pkt *ParsedPacket) bool { return pkt.HasWindow }); last != ack.pkt {
+		t.Fatalf("server sent another %s after the ack", last.Type)
+	}
+	if advertised != ack.pkt.Window {
+		t.Errorf("lastAdvertisedWindow is %d, but the peer was told %d", advertised, ack.pkt.Window)
+	}
+}
+
+// newUnansweredSession creates a client session whose packets never reach anybody
+func newUnansweredSession(t *testing.T, config *SessionConfig) *TunnelSession {
+	t.Helper()
+	keys := newTestKeyManager(t)
+	discard := func(url string, event *nostr.Event) <-chan error { return answered(nil) }
+	queue := newPublishQueue([]string{"mem://nowhere"}, discard, "Test: Client", false)
+	session := newTunnelSession("test", "Client", queue, keys, newTestKeyManager(t).GetKeys().PublicKey, "client_to_server", "", config, false)
+	t.Cleanup(session.shutdown)
+	return session
+}
+
+func TestSilentPeerAbortsWithoutSuspending(t *testing.T) {
+	config := DefaultSessionConfig()
+	config.HeartbeatInterval = 100 * time.Millisecond
+	config.PeerTimeout = 300 * time.Millisecond
+	session := newUnansweredSession(t, config)
+
+	if err := session.Send(PacketTypeOpen, nil, session.HandshakeTags()...); err != nil {
+		t.Fatalf("send open: %v", err)
+	}
+	select {
+	case _, ok := <-session.Incoming():
+		if ok {
+			t.Fatal("received a packet from nobody")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session still waiting for a peer that never answered")
+	}
+
+	session.mutex.Lock()
+	suspended := !session.suspendedSince.IsZero()
+	session.mutex.Unlock()
+	if suspended {
+		t.Error("session suspended although the peer was never heard from")
+	}
+	if session.Err() == nil {
+		t.Error("session ended without an error")
+	}
+}
+
+func TestCoalescedDataIsSplitAtTarget(t *testing.T) {
+	config := DefaultSessionConfig()
+	config.CoalesceSize = 100
+	pair := newTestPair(t, config)
+
+	if err := pair.client.Send(PacketTypeData, make([]byte, 250)); err != nil {
+		t.Fatalf("send data: %v", err)
+	}
+	for _, want := range []int{100, 100, 50} {
+		if pkt := expectIncoming(t, pair.server, PacketTypeData); len(pkt.Packet.Data) != want {
+			t.Errorf("received %d bytes, want %d", len(pkt.Packet.Data), want)
+		}
+	}
+}
+
+func TestStrayFragmentAbortsSession(t *testing.T) {
+	pair := newTestPair(t, DefaultSessionConfig())
+
+	// The second half of a chunk whose start was never sent
+	if err := pair.client.Send(PacketTypeData, []byte("half"), fragmentTag(1, 2)); err != nil {
+		t.Fatalf("send fragment: %v", err)
+	}
+	select {
+	case pkt, ok := <-pair.server.Incoming():
+		if ok {
+			t.Fatalf("server delivered %q from a partial chunk", pkt.Packet.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server kept the session open")
+	}
+	if pair.server.Err() == nil {
+		t.Error("server session ended without an error")
+	}
+}